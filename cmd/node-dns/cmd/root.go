@@ -17,8 +17,11 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"k8s.io/klog"
@@ -50,17 +53,132 @@ containers running on the host.`,
 		config.ListenInterface = viper.GetString("listeninterface")
 		config.ListenPort = viper.GetInt("listenport")
 		config.UpdateResolvConf = viper.GetBool("updateresolvconf")
-		config.Feed.K8sapi.Enabled = viper.GetBool("feed.k8sapi.enabled")
+		if viper.IsSet("zone") {
+			config.Zone = viper.GetString("zone")
+		}
+		if err := viper.UnmarshalKey("upstream.nameservers", &config.Upstream.Nameservers); err != nil {
+			klog.Errorf("Error reading upstream nameservers: %v", err)
+			os.Exit(1)
+		}
+		if err := viper.UnmarshalKey("upstream.zones", &config.Upstream.Zones); err != nil {
+			klog.Errorf("Error reading upstream zones: %v", err)
+			os.Exit(1)
+		}
+		if viper.IsSet("upstream.strategy") {
+			config.Upstream.Strategy = viper.GetString("upstream.strategy")
+		}
+		if viper.IsSet("upstream.timeout") {
+			config.Upstream.Timeout = viper.GetDuration("upstream.timeout")
+		}
+		if viper.IsSet("upstream.healthcheck.interval") {
+			config.Upstream.HealthCheck.Interval = viper.GetDuration("upstream.healthcheck.interval")
+		}
+		if viper.IsSet("upstream.healthcheck.failurethreshold") {
+			config.Upstream.HealthCheck.FailureThreshold = viper.GetInt("upstream.healthcheck.failurethreshold")
+		}
+		if viper.IsSet("upstream.healthcheck.name") {
+			config.Upstream.HealthCheck.Name = viper.GetString("upstream.healthcheck.name")
+		}
+		if viper.IsSet("upstream.coalesce") {
+			config.Upstream.Coalesce = viper.GetBool("upstream.coalesce")
+		}
+		if viper.IsSet("upstream.cache.enabled") {
+			config.Upstream.Cache.Enabled = viper.GetBool("upstream.cache.enabled")
+		}
+		if viper.IsSet("upstream.cache.size") {
+			config.Upstream.Cache.Size = viper.GetInt("upstream.cache.size")
+		}
+		if viper.IsSet("upstream.cache.maxttl") {
+			config.Upstream.Cache.MaxTTL = viper.GetDuration("upstream.cache.maxttl")
+		}
+		if viper.IsSet("upstream.cache.servestale") {
+			config.Upstream.Cache.ServeStale = viper.GetBool("upstream.cache.servestale")
+		}
+		if viper.IsSet("upstream.cache.stalettl") {
+			config.Upstream.Cache.StaleTTL = viper.GetDuration("upstream.cache.stalettl")
+		}
+		if viper.IsSet("feed.conflictpolicy") {
+			config.Feed.ConflictPolicy = viper.GetString("feed.conflictpolicy")
+		}
+		if viper.IsSet("feed.k8sapi.enabled") {
+			config.Feed.K8sapi.Enabled = viper.GetBool("feed.k8sapi.enabled")
+		}
+		if viper.IsSet("feed.k8sapi.priority") {
+			config.Feed.K8sapi.Priority = viper.GetInt("feed.k8sapi.priority")
+		}
 		config.Feed.K8sapi.InsecureTLS = viper.GetBool("feed.k8sapi.insecuretls")
 		config.Feed.K8sapi.Token = viper.GetString("feed.k8sapi.token")
 		config.Feed.K8sapi.URI = viper.GetString("feed.k8sapi.uri")
+		config.Feed.K8sapi.NodeName = viper.GetString("feed.k8sapi.nodename")
+		config.Feed.Docker.Enabled = viper.GetBool("feed.docker.enabled")
+		if viper.IsSet("feed.docker.priority") {
+			config.Feed.Docker.Priority = viper.GetInt("feed.docker.priority")
+		}
+		if viper.IsSet("feed.docker.socket") {
+			config.Feed.Docker.Socket = viper.GetString("feed.docker.socket")
+		}
+		if viper.IsSet("feed.docker.label") {
+			config.Feed.Docker.Label = viper.GetString("feed.docker.label")
+		}
+		config.Feed.CRI.Enabled = viper.GetBool("feed.cri.enabled")
+		if viper.IsSet("feed.cri.priority") {
+			config.Feed.CRI.Priority = viper.GetInt("feed.cri.priority")
+		}
+		if viper.IsSet("feed.cri.endpoint") {
+			config.Feed.CRI.Endpoint = viper.GetString("feed.cri.endpoint")
+		}
+		if viper.IsSet("feed.cri.label") {
+			config.Feed.CRI.Label = viper.GetString("feed.cri.label")
+		}
+		config.Feed.Static.Enabled = viper.GetBool("feed.static.enabled")
+		if viper.IsSet("feed.static.priority") {
+			config.Feed.Static.Priority = viper.GetInt("feed.static.priority")
+		}
+		config.Feed.Static.Files = viper.GetStringSlice("feed.static.files")
+		if err := viper.UnmarshalKey("feed.static.records", &config.Feed.Static.Records); err != nil {
+			klog.Errorf("Error reading static records: %v", err)
+			os.Exit(1)
+		}
+		if viper.IsSet("feed.k8sapi.watch") {
+			config.Feed.K8sapi.Watch = viper.GetBool("feed.k8sapi.watch")
+		}
+		config.Feed.K8sapi.Compat = viper.GetBool("feed.k8sapi.compat")
+		if viper.IsSet("feed.clusterdomain") {
+			config.Feed.ClusterDomain = viper.GetString("feed.clusterdomain")
+		}
+		if viper.IsSet("feed.k8sapi.readyonly") {
+			config.Feed.K8sapi.ReadyOnly = viper.GetBool("feed.k8sapi.readyonly")
+		}
+		if viper.IsSet("feed.k8sapi.graceperiod") {
+			config.Feed.K8sapi.GracePeriod = viper.GetDuration("feed.k8sapi.graceperiod")
+		}
+		config.Feed.Services.Enabled = viper.GetBool("feed.services.enabled")
+		if viper.IsSet("feed.services.priority") {
+			config.Feed.Services.Priority = viper.GetInt("feed.services.priority")
+		}
+		config.Feed.Services.ClusterIPFallback = viper.GetBool("feed.services.clusteripfallback")
+		if viper.IsSet("feed.k8sapi.labelkey") {
+			config.Feed.K8sapi.LabelKey = viper.GetString("feed.k8sapi.labelkey")
+		}
+		if viper.IsSet("feed.k8sapi.nametemplates") {
+			config.Feed.K8sapi.NameTemplates = viper.GetStringSlice("feed.k8sapi.nametemplates")
+		}
 		dns, err := dns.NewEdgeDNS(config)
 		if err != nil {
 			klog.Errorf("Error creating DNS: %v", err)
 			os.Exit(1)
 		}
 		klog.Infof("Starting DNS server")
-		dns.Run()
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = dns.Run(ctx)
+		if closeErr := dns.Close(); closeErr != nil {
+			klog.Errorf("Error closing DNS: %v", closeErr)
+		}
+		if err != nil {
+			klog.Errorf("Error running DNS: %v", err)
+			os.Exit(1)
+		}
 	},
 }
 
@@ -18,6 +18,7 @@ package config
 
 import (
 	feed "github.com/edgefarm/node-dns/pkg/feed/config"
+	upstream "github.com/edgefarm/node-dns/pkg/upstream/config"
 )
 
 // DNSConfig contains the configuration for the DNS
@@ -32,10 +33,16 @@ type DNSConfig struct {
 	UpdateResolvConf bool `json:"updateResolvConf"`
 	// Feed defines the feeds the DNS server gets its information from
 	Feed *feed.FeedConfig `json:"feed"`
+	// Upstream defines how queries are forwarded to the other nameservers
+	Upstream *upstream.UpstreamConfig `json:"upstream"`
 	// ResolvConf is the path to the resolv.conf file
 	ResolvConf string `json:"resolvConf"`
 	// RemoveSearchDomains defines if the `search` fields in resolv.conf shall be removed
 	RemoveSearchDomains bool `json:"removeSearchDomains"`
+	// Zone is the local zone node-dns is authoritative for. All names can also be resolved
+	// within this zone, unknown names in it are answered with NXDOMAIN. Empty disables the zone.
+	// default: node-dns.local
+	Zone string `json:"zone"`
 }
 
 // NewDNSConfig gets the default DNS configuration
@@ -44,8 +51,10 @@ func NewDNSConfig() *DNSConfig {
 		ListenInterface:     "docker0",
 		ListenPort:          53,
 		Feed:                feed.NewFeedConfig(),
+		Upstream:            upstream.NewUpstreamConfig(),
 		UpdateResolvConf:    true,
 		ResolvConf:          "/etc/resolv.conf",
 		RemoveSearchDomains: true,
+		Zone:                "node-dns.local",
 	}
 }
@@ -22,136 +22,423 @@ import (
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/edgefarm/node-dns/pkg/records"
 	mdns "github.com/miekg/dns"
-	"k8s.io/klog/v2"
 )
 
-var (
-	// DNSMap is a map of hostnames with their corresponding IP addresses
-	DNSMap           = map[string]string{}
-	otherNameservers = []string{}
+const (
+	// ednsUDPSize is the EDNS0 buffer size advertised in locally built responses
+	ednsUDPSize = 1232
+	// maxCNAMEChain limits the number of CNAME records followed to answer a query
+	maxCNAMEChain = 8
 )
 
-type handler struct{}
+type handler struct {
+	// ctx is cancelled when the servers shut down, it ends the upstream queries in flight
+	ctx       context.Context
+	forwarder Forwarder
+	zone      *zone
+	// clusterZone is the Kubernetes cluster domain, whose names are not relative to the zone
+	clusterZone *zone
+	records     *records.Store
+	log         Logger
+}
 
 // ServeDNS handles the DNS requests
 func (h *handler) ServeDNS(w mdns.ResponseWriter, r *mdns.Msg) {
-	msg := mdns.Msg{}
-	msg.SetReply(r)
-	switch r.Question[0].Qtype {
-	case mdns.TypeA:
+	if len(r.Question) == 0 {
+		h.reply(w, r, mdns.RcodeFormatError)
+		return
+	}
+	question := r.Question[0]
+	name, inZone := h.zone.relative(question.Name)
+	authority := h.authority(question.Name, inZone)
+	snapshot := h.records.Load()
+	_, ok := snapshot.Lookup(name)
+	switch {
+	case ok:
+		msg := new(mdns.Msg)
+		msg.SetReply(r)
 		msg.Authoritative = true
-		domain := msg.Question[0].Name
-		domainTrimmed := strings.TrimRight(domain, ".")
-		address, ok := lookup(domainTrimmed)
-		if ok {
-			msg.Answer = append(msg.Answer, &mdns.A{
-				Hdr: mdns.RR_Header{Name: domain, Rrtype: mdns.TypeA, Class: mdns.ClassINET, Ttl: 60},
-				A:   address,
-			})
-		} else {
+		if err := h.answer(msg, snapshot, question, name, inZone, authority); err != nil {
+			h.log.Warningf("failed to answer %s: %v", question.Name, err)
+			h.reply(w, r, mdns.RcodeServerFailure)
 			return
 		}
+		msg.Extra = mdns.Dedup(msg.Extra, nil)
+		h.write(w, r, msg)
+	case authority != nil:
+		msg := new(mdns.Msg)
+		msg.SetReply(r)
+		msg.Authoritative = true
+		apex := strings.ToLower(mdns.Fqdn(question.Name)) == authority.origin
+		if !apex {
+			msg.Rcode = mdns.RcodeNameError
+		}
+		if apex && question.Qtype == mdns.TypeSOA {
+			msg.Answer = append(msg.Answer, authority.soa())
+		} else {
+			msg.Ns = append(msg.Ns, authority.soa())
+		}
+		h.write(w, r, msg)
+	default:
+		h.forward(w, r)
 	}
-	if err := w.WriteMsg(&msg); err != nil {
-		klog.Errorf("dns response send error: %v", err)
+}
+
+// authority returns the zone that is authoritative for the name, or nil if the name is forwarded
+func (h *handler) authority(name string, inZone bool) *zone {
+	switch {
+	case inZone:
+		return h.zone
+	case h.clusterZone.contains(name):
+		return h.clusterZone
 	}
+	return nil
 }
 
-// Run starts the DNS server
-func (dns *EdgeDNS) Run() {
-	go func() {
-		klog.Infof("other nameservers: %v %p updateresolvconf %v", otherNameservers, &otherNameservers, dns.UpdateResolvConf)
-		if dns.UpdateResolvConf {
-			dns.ensureResolvForHost()
-			otherNameservers = dns.otherNameservers()
-			err := dns.ensureRemovedSearchDomains()
-			if err != nil {
-				klog.Errorf("%v", err)
+// answer adds the records of a known name to the message. CNAME records are followed within the
+// records, targets outside of them are resolved using the forwarder. Empty answers carry the SOA
+// record of the authoritative zone.
+func (h *handler) answer(msg *mdns.Msg, snapshot *records.Snapshot, question mdns.Question, name string, inZone bool, authority *zone) error {
+	owner := question.Name
+	for i := 0; i <= maxCNAMEChain; i++ {
+		found, _ := snapshot.LookupType(name, question.Qtype)
+		if len(found) == 0 && question.Qtype != mdns.TypeCNAME {
+			if cnames, _ := snapshot.LookupType(name, mdns.TypeCNAME); len(cnames) > 0 {
+				cname := cnames[0]
+				msg.Answer = append(msg.Answer, h.recordRR(owner, cname, inZone))
+				if strings.HasSuffix(cname.Target, ".") {
+					return h.resolveTarget(msg, question, cname.Target)
+				}
+				owner = h.zone.qualify(cname.Target, inZone)
+				name = cname.Target
+				continue
 			}
 		}
-		err := dns.Feed.Update()
+		for _, record := range found {
+			if rr := h.recordRR(owner, record, inZone); rr != nil {
+				msg.Answer = append(msg.Answer, rr)
+			}
+			msg.Extra = append(msg.Extra, h.additionalRRs(snapshot, record, inZone)...)
+		}
+		if len(found) == 0 && authority != nil {
+			msg.Ns = append(msg.Ns, authority.soa())
+		}
+		return nil
+	}
+	return fmt.Errorf("more than %d CNAME records in a row", maxCNAMEChain)
+}
+
+// resolveTarget adds the upstream answer of a CNAME target outside of the records to the message
+func (h *handler) resolveTarget(msg *mdns.Msg, question mdns.Question, target string) error {
+	req := new(mdns.Msg)
+	req.SetQuestion(target, question.Qtype)
+	req.Question[0].Qclass = question.Qclass
+	resp, err := h.forwarder.Forward(h.ctx, req)
+	if err != nil {
+		return err
+	}
+	msg.Answer = append(msg.Answer, resp.Answer...)
+	msg.Rcode = resp.Rcode
+	return nil
+}
+
+// forward passes the request to the other nameservers and sends back their response
+func (h *handler) forward(w mdns.ResponseWriter, r *mdns.Msg) {
+	resp, err := h.forwarder.Forward(h.ctx, r)
+	if err != nil {
+		h.log.Warningf("failed to forward %s: %v", r.Question[0].Name, err)
+		h.reply(w, r, mdns.RcodeServerFailure)
+		return
+	}
+	h.write(w, r, resp)
+}
+
+// reply sends back an empty response with the given rcode
+func (h *handler) reply(w mdns.ResponseWriter, r *mdns.Msg, rcode int) {
+	msg := new(mdns.Msg)
+	msg.SetRcode(r, rcode)
+	h.write(w, r, msg)
+}
+
+// write sends the response, truncated to the size the client is able to receive
+func (h *handler) write(w mdns.ResponseWriter, r *mdns.Msg, msg *mdns.Msg) {
+	size := mdns.MaxMsgSize
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		size = mdns.MinMsgSize
+	}
+	if opt := r.IsEdns0(); opt != nil {
+		if msg.IsEdns0() == nil {
+			msg.SetEdns0(ednsUDPSize, opt.Do())
+		}
+		if size == mdns.MinMsgSize && int(opt.UDPSize()) > size {
+			size = int(opt.UDPSize())
+		}
+	}
+	msg.Truncate(size)
+	if err := w.WriteMsg(msg); err != nil {
+		h.log.Errorf("dns response send error: %v", err)
+	}
+}
+
+// recordRR creates the resource record of a record using the given owner name.
+// Targets are qualified with the zone if the query was made within the zone.
+func (h *handler) recordRR(owner string, record records.Record, inZone bool) mdns.RR {
+	hdr := mdns.RR_Header{Name: owner, Rrtype: record.Type, Class: mdns.ClassINET, Ttl: recordTTL}
+	switch record.Type {
+	case mdns.TypeA:
+		return &mdns.A{Hdr: hdr, A: record.Address}
+	case mdns.TypeAAAA:
+		return &mdns.AAAA{Hdr: hdr, AAAA: record.Address}
+	case mdns.TypePTR:
+		return &mdns.PTR{Hdr: hdr, Ptr: h.zone.qualify(record.Target, inZone)}
+	case mdns.TypeSRV:
+		return &mdns.SRV{
+			Hdr:      hdr,
+			Priority: record.Priority,
+			Weight:   record.Weight,
+			Port:     record.Port,
+			Target:   h.zone.qualify(record.Target, inZone),
+		}
+	case mdns.TypeTXT:
+		return &mdns.TXT{Hdr: hdr, Txt: record.Text}
+	case mdns.TypeCNAME:
+		return &mdns.CNAME{Hdr: hdr, Target: h.zone.qualify(record.Target, inZone)}
+	}
+	return nil
+}
+
+// additionalRRs returns the records for the additional section of an answer. SRV answers
+// carry the addresses of their target, DNS-SD instance PTR answers carry the SRV and TXT
+// records of the instance as well (RFC 6763 section 12).
+func (h *handler) additionalRRs(snapshot *records.Snapshot, record records.Record, inZone bool) []mdns.RR {
+	rrs := []mdns.RR{}
+	switch record.Type {
+	case mdns.TypeSRV:
+		rrs = append(rrs, h.targetRRs(snapshot, record.Target, inZone, mdns.TypeA, mdns.TypeAAAA)...)
+	case mdns.TypePTR:
+		found, _ := snapshot.LookupType(record.Target, mdns.TypeSRV)
+		rrs = append(rrs, h.targetRRs(snapshot, record.Target, inZone, mdns.TypeSRV, mdns.TypeTXT)...)
+		for _, srv := range found {
+			rrs = append(rrs, h.targetRRs(snapshot, srv.Target, inZone, mdns.TypeA, mdns.TypeAAAA)...)
+		}
+	}
+	return rrs
+}
+
+// targetRRs returns the records of a target name with one of the given types
+func (h *handler) targetRRs(snapshot *records.Snapshot, target string, inZone bool, rrtypes ...uint16) []mdns.RR {
+	rrs := []mdns.RR{}
+	found, _ := snapshot.Lookup(target)
+	owner := h.zone.qualify(target, inZone)
+	for _, record := range found {
+		for _, rrtype := range rrtypes {
+			if record.Type != rrtype {
+				continue
+			}
+			if rr := h.recordRR(owner, record, inZone); rr != nil {
+				rrs = append(rrs, rr)
+			}
+		}
+	}
+	return rrs
+}
+
+// Run starts the DNS server and blocks until the context is cancelled or the server fails.
+// On return the servers are shut down and resolv.conf is restored.
+func (dns *EdgeDNS) Run(ctx context.Context) error {
+	packetConn, listener := dns.packetConn, dns.listener
+	if packetConn == nil {
+		var err error
+		packetConn, listener, err = listen(dns.ListenAddr)
 		if err != nil {
-			klog.Errorf("failed to update dns server, err: %v", err)
+			return err
 		}
-		DNSMap = dns.Feed.GetDNSMap()
-		klog.Infof("Currently resolvable:")
-		for host, ip := range DNSMap {
-			klog.Infof("  %s -> %s", host, ip)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	h := &handler{
+		ctx:         ctx,
+		forwarder:   dns.forwarder,
+		zone:        dns.Zone,
+		clusterZone: dns.ClusterZone,
+		records:     dns.Records,
+		log:         dns.log,
+	}
+	servers := []*mdns.Server{
+		{PacketConn: packetConn, Handler: h, UDPSize: mdns.DefaultMsgSize},
+		{Listener: listener, Handler: h},
+	}
+
+	errs := make(chan error, len(servers))
+	started := sync.WaitGroup{}
+	started.Add(len(servers))
+	for _, server := range servers {
+		server.NotifyStartedFunc = started.Done
+		go func(server *mdns.Server) {
+			errs <- server.ActivateAndServe()
+		}(server)
+	}
+	started.Wait()
+	dns.log.Infof("dns server listening on %s", packetConn.LocalAddr())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dns.maintain(ctx)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		err = fmt.Errorf("dns server serve error: %v", err)
+		cancel()
+	}
+	for _, server := range servers {
+		if shutdownErr := server.Shutdown(); shutdownErr != nil {
+			dns.log.Warningf("failed to shut down dns server: %v", shutdownErr)
+		}
+	}
+	<-done
+	return err
+}
+
+// maintain keeps the records and resolv.conf up to date until the context is cancelled
+func (dns *EdgeDNS) maintain(ctx context.Context) {
+	dns.log.Infof("other nameservers: %v updateresolvconf %v", dns.otherNameservers(), dns.UpdateResolvConf)
+	if dns.UpdateResolvConf {
+		dns.ensureResolvForHost()
+		dns.updateNameservers()
+		err := dns.ensureRemovedSearchDomains()
+		if err != nil {
+			dns.log.Errorf("%v", err)
 		}
-		ticker := time.NewTicker(time.Second * 30)
-		for {
-			select {
-			case <-ticker.C:
-				err := dns.Feed.Update()
+	}
+
+	for _, forwarder := range dns.upstreams {
+		go forwarder.Probe(ctx)
+	}
+
+	changed := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case changed <- struct{}{}:
+		default:
+		}
+	}
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		dns.Feeds.Watch(ctx.Done(), notify)
+	}()
+
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-changed:
+			dns.updateRecords()
+		case <-ticker.C:
+			dns.logStats()
+			dns.updateNameservers()
+			if dns.UpdateResolvConf {
+				dns.log.Infof("  Updating resolv")
+				dns.ensureResolvForHost()
+				dns.updateNameservers()
+				err := dns.ensureRemovedSearchDomains()
 				if err != nil {
-					klog.Errorf("failed to update dns server, err: %v", err)
-				}
-				DNSMap = dns.Feed.GetDNSMap()
-				klog.Infof("Currently resolvable:")
-				for host, ip := range DNSMap {
-					klog.Infof("  %s -> %s", host, ip)
-				}
-				otherNameservers = dns.otherNameservers()
-				if dns.UpdateResolvConf {
-					klog.Infof("  Updating resolv")
-					dns.ensureResolvForHost()
-					otherNameservers = dns.otherNameservers()
-					err := dns.ensureRemovedSearchDomains()
-					if err != nil {
-						klog.Errorf("%v", err)
-					}
+					dns.log.Errorf("%v", err)
 				}
-			case <-dns.Exit:
-				if dns.UpdateResolvConf {
-					dns.cleanResolvForHost()
-				}
-				return
 			}
+		case <-ctx.Done():
+			<-watching
+			if dns.UpdateResolvConf {
+				dns.cleanResolvForHost()
+			}
+			return
 		}
-	}()
-	dns.Server.Handler = &handler{}
-	if err := dns.Server.ListenAndServe(); err != nil {
-		klog.Errorf("dns server serve error: %v", err)
 	}
 }
 
-// Stop stops the DNS server
-func (dns *EdgeDNS) Stop() error {
-	dns.Exit <- true
-	err := dns.Server.Shutdown()
-	if err != nil {
-		return err
+// logStats logs the counters of the upstream queries
+func (dns *EdgeDNS) logStats() {
+	if dns.coalescer != nil {
+		stats := dns.UpstreamStats()
+		dns.log.Infof("upstream queries: %d forwarded, %d coalesced", stats.Forwarded, stats.Coalesced)
 	}
-	return nil
 }
 
-// getIPForURI returns the IP for an URI
-func getIPForURI(URI string) (string, error) {
-	if ip, ok := DNSMap[URI]; ok {
-		return ip, nil
+// updateNameservers passes the other nameservers of resolv.conf to the default forwarder
+func (dns *EdgeDNS) updateNameservers() {
+	if dns.resolvConfUpstream != nil {
+		dns.resolvConfUpstream.SetNameservers(dns.otherNameservers())
 	}
-	ips, err := lookupUpstreamHost(context.Background(), URI)
-	if err != nil {
-		return "", err
+}
+
+// updateRecords builds a new snapshot of the records from the feeds and swaps it in
+func (dns *EdgeDNS) updateRecords() {
+	builder := records.NewBuilder()
+	for host, entries := range dns.Feeds.Entries() {
+		for _, entry := range entries {
+			if err := builder.AddAddress(host, entry.Address, entry.Source); err != nil {
+				dns.log.Warningf("ignoring record: %v", err)
+			}
+		}
 	}
-	if len(ips) == 0 {
-		return "", fmt.Errorf("no IP found for %s", URI)
+	for _, record := range dns.Feeds.Records() {
+		builder.Add(record)
+	}
+	snapshot := builder.Build()
+	dns.Records.Replace(snapshot)
+
+	dns.log.Infof("Currently resolvable:")
+	for _, name := range snapshot.Names() {
+		found, _ := snapshot.Lookup(name)
+		values := []string{}
+		for _, record := range found {
+			value := record.Target
+			switch {
+			case record.Address != nil:
+				value = record.Address.String()
+			case record.Type == mdns.TypeSRV:
+				value = fmt.Sprintf("%s:%d", record.Target, record.Port)
+			case record.Type == mdns.TypeTXT:
+				value = strings.Join(record.Text, " ")
+			}
+			values = append(values, fmt.Sprintf("%s (%s)", value, record.Source))
+		}
+		dns.log.Infof("  %s -> %s", name, strings.Join(values, ", "))
 	}
-	return ips[0], nil
 }
 
-// lookup confirms if the service exists
-func lookup(URI string) (ip net.IP, exist bool) {
-	ipAddress, err := getIPForURI(URI)
+// listen binds the UDP and TCP sockets to the same address. If the port is 0,
+// the port chosen for UDP is used for TCP as well.
+func listen(addr string) (net.PacketConn, net.Listener, error) {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, nil, err
+	}
+	_, port, err := net.SplitHostPort(packetConn.LocalAddr().String())
 	if err != nil {
-		klog.Warningf("%v", err)
-		return nil, false
+		packetConn.Close()
+		return nil, nil, err
 	}
-	klog.Infof("dns server parse %s ip %s", URI, ipAddress)
-	return net.ParseIP(ipAddress), true
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		packetConn.Close()
+		return nil, nil, err
+	}
+	return packetConn, listener, nil
 }
 
 func (dns *EdgeDNS) ensureRemovedSearchDomains() error {
@@ -209,14 +496,14 @@ func (dns *EdgeDNS) ensureResolvForHost() {
 	if dns.ListenIP != nil {
 		resolv, err := readFile(dns.ResolvConf)
 		if err != nil {
-			klog.Errorf("%v", err)
+			dns.log.Errorf("%v", err)
 			return
 		}
-		klog.Infof("dns server read resolv %s: %v", dns.ResolvConf, resolv)
+		dns.log.Infof("dns server read resolv %s: %v", dns.ResolvConf, resolv)
 		if resolv == nil {
 			nameserver := "nameserver " + dns.ListenIP.String()
 			if err := writeFile(dns.ResolvConf, []byte(nameserver)); err != nil {
-				klog.Errorf("err: %v", err)
+				dns.log.Errorf("err: %v", err)
 				return
 			}
 		}
@@ -240,13 +527,13 @@ func (dns *EdgeDNS) ensureResolvForHost() {
 		if configured {
 			if dnsIdx != startIdx && dnsIdx > startIdx {
 				nameserver := sortNameserver(resolv, dnsIdx, startIdx)
-				klog.Infof("write configured resolv %s: %v", dns.ResolvConf, nameserver)
+				dns.log.Infof("write configured resolv %s: %v", dns.ResolvConf, nameserver)
 				if err := writeFile(dns.ResolvConf, []byte(nameserver)); err != nil {
-					klog.Errorf("err: %v", err)
+					dns.log.Errorf("err: %v", err)
 					return
 				}
 			}
-			klog.Infof("ensureResolvForHost return wo writing")
+			dns.log.Infof("ensureResolvForHost return wo writing")
 			return
 		}
 
@@ -261,9 +548,9 @@ func (dns *EdgeDNS) ensureResolvForHost() {
 			idx++
 		}
 
-		klog.Infof("write non-configured resolv %s: %v", dns.ResolvConf, nameserver)
+		dns.log.Infof("write non-configured resolv %s: %v", dns.ResolvConf, nameserver)
 		if err := writeFile(dns.ResolvConf, []byte(nameserver)); err != nil {
-			klog.Errorf("err: %v", err)
+			dns.log.Errorf("err: %v", err)
 			return
 		}
 	}
@@ -273,7 +560,7 @@ func (dns *EdgeDNS) ensureResolvForHost() {
 func (dns *EdgeDNS) otherNameservers() []string {
 	resolv, err := readFile(dns.ResolvConf)
 	if err != nil {
-		klog.Errorf("failed to read file %s, err: %v", dns.ResolvConf, err)
+		dns.log.Errorf("failed to read file %s, err: %v", dns.ResolvConf, err)
 	}
 
 	nameservers := []string{}
@@ -290,7 +577,7 @@ func (dns *EdgeDNS) otherNameservers() []string {
 		}
 
 	}
-	klog.Infof("read otherNameServers: my ip=%s others=%v", dns.ListenIP.String(), others)
+	dns.log.Infof("read otherNameServers: my ip=%s others=%v", dns.ListenIP.String(), others)
 	return others
 }
 
@@ -317,7 +604,7 @@ func sortNameserver(resolv []string, dnsIdx, startIdx int) string {
 func (dns *EdgeDNS) cleanResolvForHost() {
 	resolv, err := readFile(dns.ResolvConf)
 	if err != nil {
-		klog.Warningf("read file %s err: %v", dns.ResolvConf, err)
+		dns.log.Warningf("read file %s err: %v", dns.ResolvConf, err)
 	}
 
 	nameserver := ""
@@ -328,36 +615,6 @@ func (dns *EdgeDNS) cleanResolvForHost() {
 		nameserver = nameserver + item + "\n"
 	}
 	if err := ioutil.WriteFile(dns.ResolvConf, []byte(nameserver), 0600); err != nil {
-		klog.Errorf("failed to write nameserver to file %s, err: %v", dns.ResolvConf, err)
-	}
-}
-
-func lookupUpstreamHost(ctx context.Context, URI string) ([]string, error) {
-	address := []string{}
-	var lastErr error = nil
-	for _, other := range otherNameservers {
-		r := &net.Resolver{
-			PreferGo: true,
-			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
-				otherHost := ctx.Value("otherHost")
-
-				d := net.Dialer{
-					Timeout: time.Millisecond * time.Duration(10000),
-				}
-				return d.DialContext(ctx, network, fmt.Sprintf("%s:53", otherHost))
-			},
-		}
-		ctx := context.WithValue(context.Background(), "otherHost", other)
-		found, err := r.LookupHost(ctx, URI)
-		if err != nil {
-			klog.Infof("cannot resolve %s using %s, err: %v", URI, other, err)
-			lastErr = err
-			continue
-		}
-		if len(found) > 0 && err == nil {
-			address = found
-			break
-		}
+		dns.log.Errorf("failed to write nameserver to file %s, err: %v", dns.ResolvConf, err)
 	}
-	return address, lastErr
 }
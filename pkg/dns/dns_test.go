@@ -20,10 +20,18 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/edgefarm/node-dns/pkg/dns/config"
+	"github.com/edgefarm/node-dns/pkg/records"
+	"github.com/edgefarm/node-dns/pkg/upstream"
+	upstreamconfig "github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -81,20 +89,6 @@ func TestRemoveSearchDomains(t *testing.T) {
 	assert.Contains(resolv, "nameserver 4.4.4.4")
 }
 
-func TestLookupUptreamHost(t *testing.T) {
-	assert := assert.New(t)
-	_, file := setupEdgeDNS(t, predefinedResolvConf)
-	defer cleanupEdgeDNS(t, file)
-	ips, err := lookupUpstreamHost(context.Background(), "example.com")
-	assert.Nil(err)
-	assert.NotEmpty(ips)
-
-	ips, err = lookupUpstreamHost(context.Background(), "impossibledomain")
-	fmt.Println(err)
-	assert.NotNil(err)
-	assert.Empty(ips)
-}
-
 func TestGetOtherNameservers(t *testing.T) {
 	assert := assert.New(t)
 	e, file := setupEdgeDNS(t, predefinedResolvConf)
@@ -115,3 +109,457 @@ func TestGetOtherNameservers2(t *testing.T) {
 	assert.Contains(others, "10.0.0.1")
 	assert.Equal(len(others), 3)
 }
+
+// testWriter records the response written by the handler
+type testWriter struct {
+	mdns.ResponseWriter
+	remote net.Addr
+	msg    *mdns.Msg
+}
+
+func (w *testWriter) RemoteAddr() net.Addr {
+	if w.remote == nil {
+		return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53535}
+	}
+	return w.remote
+}
+
+func (w *testWriter) WriteMsg(msg *mdns.Msg) error {
+	w.msg = msg
+	return nil
+}
+
+// newTestHandler creates a handler serving the addresses without any other nameservers
+func newTestHandler(t *testing.T, dnsMap map[string][]string) *handler {
+	builder := records.NewBuilder()
+	for name, ips := range dnsMap {
+		for _, ip := range ips {
+			assert.Nil(t, builder.AddAddress(name, ip, "test"))
+		}
+	}
+	store := records.NewStore()
+	store.Replace(builder.Build())
+	return &handler{
+		ctx:       context.Background(),
+		forwarder: upstream.NewForwarder(nil),
+		zone:      newZone("node-dns.local"),
+		records:   store,
+		log:       klogLogger{},
+	}
+}
+
+func query(h *handler, name string, qtype uint16) *mdns.Msg {
+	req := new(mdns.Msg)
+	req.SetQuestion(name, qtype)
+	w := &testWriter{}
+	h.ServeDNS(w, req)
+	return w.msg
+}
+
+func TestServeLocalZone(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{"nginx.mypod": {"172.17.0.2"}})
+
+	resp := query(h, "nginx.mypod.", mdns.TypeA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+
+	resp = query(h, "NGINX.mypod.node-dns.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+	assert.Equal("NGINX.mypod.node-dns.local.", resp.Answer[0].Header().Name)
+
+	resp = query(h, "nginx.mypod.node-dns.local.", mdns.TypeAAAA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Empty(resp.Answer)
+	assert.Len(resp.Ns, 1)
+	assert.Equal(mdns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	resp = query(h, "typo.mypod.node-dns.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+	assert.True(resp.Authoritative)
+	assert.Len(resp.Ns, 1)
+	assert.Equal(mdns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+	resp = query(h, "node-dns.local.", mdns.TypeSOA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+}
+
+func TestServeReverse(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{"nginx.mypod": {"172.17.0.2", "fd00::2"}})
+
+	resp := query(h, "2.0.17.172.in-addr.arpa.", mdns.TypePTR)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+	assert.Equal("nginx.mypod.", resp.Answer[0].(*mdns.PTR).Ptr)
+
+	reverse, err := mdns.ReverseAddr("fd00::2")
+	assert.Nil(err)
+	resp = query(h, reverse, mdns.TypePTR)
+	assert.Len(resp.Answer, 1)
+	assert.Equal("nginx.mypod.", resp.Answer[0].(*mdns.PTR).Ptr)
+
+	// unknown addresses are forwarded, which fails without nameservers
+	resp = query(h, "3.0.17.172.in-addr.arpa.", mdns.TypePTR)
+	assert.Equal(mdns.RcodeServerFailure, resp.Rcode)
+}
+
+func TestServeService(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{})
+	builder := records.NewBuilder()
+	assert.Nil(builder.AddAddress("nginx.mypod", "172.17.0.2", "test"))
+	assert.Nil(builder.AddAddress("nginx.mypod", "fd00::2", "test"))
+	builder.Add(records.Record{Name: "_http._tcp.nginx.mypod", Type: mdns.TypeSRV, Target: "nginx.mypod", Port: 8080, Weight: 100})
+	h.records.Replace(builder.Build())
+
+	resp := query(h, "_http._tcp.nginx.mypod.node-dns.local.", mdns.TypeSRV)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+	srv := resp.Answer[0].(*mdns.SRV)
+	assert.Equal(uint16(8080), srv.Port)
+	assert.Equal("nginx.mypod.node-dns.local.", srv.Target)
+	assert.Len(resp.Extra, 2)
+	assert.Equal("nginx.mypod.node-dns.local.", resp.Extra[0].Header().Name)
+
+	resp = query(h, "_http._tcp.nginx.mypod.", mdns.TypeSRV)
+	assert.Equal("nginx.mypod.", resp.Answer[0].(*mdns.SRV).Target)
+}
+
+func TestServeServiceBrowsing(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{})
+	builder := records.NewBuilder()
+	assert.Nil(builder.AddAddress("nginx.mypod", "172.17.0.2", "test"))
+	builder.Add(records.Record{Name: "_services._dns-sd._udp", Type: mdns.TypePTR, Target: "_http._tcp"})
+	builder.Add(records.Record{Name: "_http._tcp", Type: mdns.TypePTR, Target: "nginx-mypod._http._tcp"})
+	builder.Add(records.Record{Name: "nginx-mypod._http._tcp", Type: mdns.TypeSRV, Target: "nginx.mypod", Port: 8080})
+	builder.Add(records.Record{Name: "nginx-mypod._http._tcp", Type: mdns.TypeTXT, Text: []string{"path=/"}})
+	h.records.Replace(builder.Build())
+
+	resp := query(h, "_services._dns-sd._udp.node-dns.local.", mdns.TypePTR)
+	assert.Len(resp.Answer, 1)
+	assert.Equal("_http._tcp.node-dns.local.", resp.Answer[0].(*mdns.PTR).Ptr)
+
+	resp = query(h, "_http._tcp.node-dns.local.", mdns.TypePTR)
+	assert.Len(resp.Answer, 1)
+	assert.Equal("nginx-mypod._http._tcp.node-dns.local.", resp.Answer[0].(*mdns.PTR).Ptr)
+	assert.Len(resp.Extra, 3)
+
+	resp = query(h, "nginx-mypod._http._tcp.node-dns.local.", mdns.TypeTXT)
+	assert.Len(resp.Answer, 1)
+	assert.Equal([]string{"path=/"}, resp.Answer[0].(*mdns.TXT).Txt)
+}
+
+// addressForwarder answers every query with an A record
+type addressForwarder struct{}
+
+func (addressForwarder) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	msg := new(mdns.Msg)
+	msg.SetReply(r)
+	rr, err := mdns.NewRR(r.Question[0].Name + " 300 IN A 192.0.2.1")
+	if err != nil {
+		return nil, err
+	}
+	msg.Answer = append(msg.Answer, rr)
+	return msg, nil
+}
+
+func TestServeCNAME(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{})
+	h.forwarder = addressForwarder{}
+	builder := records.NewBuilder()
+	assert.Nil(builder.AddAddress("backend.mypod", "172.17.0.2", "test"))
+	builder.Add(records.Record{Name: "api", Type: mdns.TypeCNAME, Target: "service"})
+	builder.Add(records.Record{Name: "service", Type: mdns.TypeCNAME, Target: "backend.mypod"})
+	builder.Add(records.Record{Name: "www", Type: mdns.TypeCNAME, Target: "example.com"})
+	builder.Add(records.Record{Name: "loop1", Type: mdns.TypeCNAME, Target: "loop2"})
+	builder.Add(records.Record{Name: "loop2", Type: mdns.TypeCNAME, Target: "loop1"})
+	h.records.Replace(builder.Build())
+
+	resp := query(h, "api.node-dns.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 3)
+	assert.Equal("service.node-dns.local.", resp.Answer[0].(*mdns.CNAME).Target)
+	assert.Equal("backend.mypod.node-dns.local.", resp.Answer[1].(*mdns.CNAME).Target)
+	assert.Equal("backend.mypod.node-dns.local.", resp.Answer[2].Header().Name)
+
+	resp = query(h, "api.node-dns.local.", mdns.TypeCNAME)
+	assert.Len(resp.Answer, 1)
+
+	resp = query(h, "www.node-dns.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 2)
+	assert.Equal("example.com.", resp.Answer[0].(*mdns.CNAME).Target)
+	assert.Equal("192.0.2.1", resp.Answer[1].(*mdns.A).A.String())
+
+	resp = query(h, "loop1.node-dns.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeServerFailure, resp.Rcode)
+}
+
+func TestServeClusterDomain(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{"172-17-0-2.shop.pod.cluster.local": {"172.17.0.2"}})
+	h.clusterZone = newZone("cluster.local")
+
+	resp := query(h, "172-17-0-2.shop.pod.cluster.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.True(resp.Authoritative)
+	assert.Len(resp.Answer, 1)
+
+	resp = query(h, "172-17-0-2.shop.pod.cluster.local.", mdns.TypeAAAA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Empty(resp.Answer)
+	assert.Equal("cluster.local.", resp.Ns[0].Header().Name)
+
+	resp = query(h, "other.shop.svc.cluster.local.", mdns.TypeA)
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+	assert.Equal("cluster.local.", resp.Ns[0].Header().Name)
+
+	resp = query(h, "cluster.local.", mdns.TypeSOA)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+	assert.Len(resp.Answer, 1)
+}
+
+func TestWithUpstreamZones(t *testing.T) {
+	assert := assert.New(t)
+	cfg := upstreamconfig.NewUpstreamConfig()
+	cfg.Zones = []upstreamconfig.ZoneConfig{
+		{Domain: "private.lan", NoForward: true},
+		{Domain: "plant.local", Nameservers: []upstreamconfig.NameserverConfig{{Address: "192.0.2.53"}}},
+	}
+	dns, err := New(WithUpstream(cfg))
+	assert.Nil(err)
+	assert.Len(dns.upstreams, 2)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("nas.private.lan.", mdns.TypeA)
+	resp, err := dns.forwarder.Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+
+	cfg.Zones = []upstreamconfig.ZoneConfig{{Domain: "plant.local"}}
+	_, err = New(WithUpstream(cfg))
+	assert.NotNil(err)
+}
+
+func TestServeUpstreamFailure(t *testing.T) {
+	assert := assert.New(t)
+	h := newTestHandler(t, map[string][]string{})
+
+	resp := query(h, "example.com.", mdns.TypeA)
+	assert.Equal(mdns.RcodeServerFailure, resp.Rcode)
+
+	w := &testWriter{}
+	h.ServeDNS(w, new(mdns.Msg))
+	assert.Equal(mdns.RcodeFormatError, w.msg.Rcode)
+}
+
+func TestServeTruncation(t *testing.T) {
+	assert := assert.New(t)
+	ips := []string{}
+	for i := 1; i <= 100; i++ {
+		ips = append(ips, fmt.Sprintf("172.17.0.%d", i))
+	}
+	h := newTestHandler(t, map[string][]string{"nginx.mypod": ips})
+
+	resp := query(h, "nginx.mypod.", mdns.TypeA)
+	assert.True(resp.Truncated)
+	assert.LessOrEqual(resp.Len(), mdns.MinMsgSize)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("nginx.mypod.", mdns.TypeA)
+	req.SetEdns0(4096, false)
+	w := &testWriter{}
+	h.ServeDNS(w, req)
+	assert.False(w.msg.Truncated)
+	assert.Len(w.msg.Answer, 100)
+	assert.NotNil(w.msg.IsEdns0())
+
+	req = new(mdns.Msg)
+	req.SetQuestion("nginx.mypod.", mdns.TypeA)
+	w = &testWriter{remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 53535}}
+	h.ServeDNS(w, req)
+	assert.False(w.msg.Truncated)
+	assert.Len(w.msg.Answer, 100)
+}
+
+// testFeed is a feed with a fixed DNS map
+type testFeed struct {
+	dnsMap map[string][]string
+}
+
+func (f *testFeed) Update(ctx context.Context) error {
+	return nil
+}
+
+func (f *testFeed) GetDNSMap() map[string][]string {
+	return f.dnsMap
+}
+
+// testForwarder answers every query with NXDOMAIN
+type testForwarder struct{}
+
+func (testForwarder) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	msg := new(mdns.Msg)
+	msg.SetRcode(r, mdns.RcodeNameError)
+	return msg, nil
+}
+
+// startTestEdgeDNS runs an instance on a random local port until the test ends
+func startTestEdgeDNS(t *testing.T, opts ...Option) string {
+	packetConn, listener, err := listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := New(append(opts, WithListeners(packetConn, listener))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		assert.Nil(t, <-done)
+	})
+	return packetConn.LocalAddr().String()
+}
+
+// blockingFeed is a feed whose updates hang until their context is cancelled, like a stuck API server
+type blockingFeed struct {
+	testFeed
+}
+
+func (f *blockingFeed) Update(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestRunReturnsWhileFeedHangs(t *testing.T) {
+	assert := assert.New(t)
+	packetConn, listener, err := listen("127.0.0.1:0")
+	assert.Nil(err)
+	e, err := New(
+		WithListeners(packetConn, listener),
+		WithFeed("blocking", 10, &blockingFeed{}),
+		WithForwarder(testForwarder{}),
+	)
+	assert.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Run(ctx)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.Nil(err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not return after the context was cancelled")
+	}
+}
+
+// failingFeed is a feed whose updates fail
+type failingFeed struct {
+	testFeed
+}
+
+func (f *failingFeed) Update(ctx context.Context) error {
+	return fmt.Errorf("feed broken")
+}
+
+// recordingLogger keeps the messages logged
+type recordingLogger struct {
+	messages []string
+	mutex    sync.Mutex
+}
+
+func (l *recordingLogger) Infof(format string, args ...interface{}) {
+	l.record(format, args...)
+}
+
+func (l *recordingLogger) Warningf(format string, args ...interface{}) {
+	l.record(format, args...)
+}
+
+func (l *recordingLogger) Errorf(format string, args ...interface{}) {
+	l.record(format, args...)
+}
+
+func (l *recordingLogger) record(format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, args...))
+}
+
+// logged checks whether a message containing text was logged
+func (l *recordingLogger) logged(text string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, msg := range l.messages {
+		if strings.Contains(msg, text) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestWithLoggerReachesFeedsAndUpstreams(t *testing.T) {
+	assert := assert.New(t)
+	log := &recordingLogger{}
+	cfg := upstreamconfig.NewUpstreamConfig()
+	cfg.Timeout = time.Second
+	cfg.Nameservers = []upstreamconfig.NameserverConfig{{Address: "127.0.0.1:1"}}
+	e, err := New(
+		WithLogger(log),
+		WithFeed("failing", 10, &failingFeed{}),
+		WithUpstream(cfg),
+	)
+	assert.Nil(err)
+
+	assert.NotNil(e.Feeds.Update(context.Background()))
+	assert.True(log.logged("failed to update feed failing"))
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	_, err = e.forwarder.Forward(context.Background(), req)
+	assert.NotNil(err)
+	assert.True(log.logged("cannot forward example.com. to 127.0.0.1:1"))
+}
+
+func TestParallelInstances(t *testing.T) {
+	for _, ip := range []string{"172.17.0.2", "172.17.0.3"} {
+		ip := ip
+		t.Run(ip, func(t *testing.T) {
+			t.Parallel()
+			assert := assert.New(t)
+			addr := startTestEdgeDNS(t,
+				WithFeed("test", 10, &testFeed{dnsMap: map[string][]string{"nginx.mypod": {ip}}}),
+				WithForwarder(testForwarder{}),
+			)
+
+			req := new(mdns.Msg)
+			req.SetQuestion("nginx.mypod.", mdns.TypeA)
+			for _, network := range []string{"udp", "tcp"} {
+				client := &mdns.Client{Net: network}
+				assert.Eventually(func() bool {
+					resp, _, err := client.Exchange(req, addr)
+					return err == nil && len(resp.Answer) == 1 && resp.Answer[0].(*mdns.A).A.String() == ip
+				}, time.Second, 10*time.Millisecond)
+			}
+
+			req.SetQuestion("example.com.", mdns.TypeA)
+			resp, _, err := new(mdns.Client).Exchange(req, addr)
+			assert.Nil(err)
+			assert.Equal(mdns.RcodeNameError, resp.Rcode)
+		})
+	}
+}
@@ -19,66 +19,170 @@ package dns
 import (
 	"fmt"
 	"net"
+	"strconv"
 
 	"github.com/edgefarm/node-dns/pkg/dns/config"
-	mdns "github.com/miekg/dns"
-	"k8s.io/klog"
-
 	"github.com/edgefarm/node-dns/pkg/feed"
+	feedconfig "github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/edgefarm/node-dns/pkg/records"
+	"github.com/edgefarm/node-dns/pkg/upstream"
+	upstreamconfig "github.com/edgefarm/node-dns/pkg/upstream/config"
 )
 
 // EdgeDNS is a node-level dns resolver
 type EdgeDNS struct {
 	ListenIP            net.IP
-	Server              *mdns.Server
-	Exit                chan interface{}
-	Feed                feed.If
+	ListenAddr          string
+	Feeds               *feed.Registry
 	UpdateResolvConf    bool
 	ResolvConf          string
 	RemoveSearchDomains bool
+	Zone                *zone
+	// ClusterZone is the Kubernetes cluster domain if node-dns is authoritative for it
+	ClusterZone *zone
+	// Records contains the records of all feeds
+	Records *records.Store
+
+	forwarder Forwarder
+	// coalesce enables coalescing identical queries passed to the forwarder
+	coalesce  bool
+	coalescer *upstream.Coalescer
+	// cacheConfig enables caching the answers of the forwarder if set
+	cacheConfig *upstreamconfig.CacheConfig
+	// upstreams are the forwarders of the default forwarder, whose nameservers are probed while running
+	upstreams []*upstream.Forwarder
+	// resolvConfUpstream is the default forwarder if it uses the other nameservers of resolv.conf
+	resolvConfUpstream *upstream.Forwarder
+	log                Logger
+	packetConn         net.PacketConn
+	listener           net.Listener
+}
+
+// New creates a new EdgeDNS instance. Without options it listens on port 53 of all
+// interfaces, has no feeds and forwards to the nameservers of /etc/resolv.conf without
+// changing it. Several instances can be run within one process.
+func New(opts ...Option) (*EdgeDNS, error) {
+	feeds, err := feed.NewRegistry(feedconfig.ConflictHighestPriorityWins)
+	if err != nil {
+		return nil, err
+	}
+	defaults := config.NewDNSConfig()
+	dns := &EdgeDNS{
+		ListenAddr: net.JoinHostPort("", strconv.Itoa(defaults.ListenPort)),
+		Feeds:      feeds,
+		ResolvConf: defaults.ResolvConf,
+		Zone:       newZone(defaults.Zone),
+		Records:    records.NewStore(),
+		log:        klogLogger{},
+	}
+	dns.resolvConfUpstream = upstream.NewForwarder(nil)
+	dns.upstreams = []*upstream.Forwarder{dns.resolvConfUpstream}
+	dns.forwarder = dns.resolvConfUpstream
+	for _, opt := range opts {
+		if err := opt(dns); err != nil {
+			return nil, err
+		}
+	}
+	dns.Feeds.SetLogger(dns.log)
+	for _, forwarder := range dns.upstreams {
+		forwarder.SetLogger(dns.log)
+	}
+	if dns.resolvConfUpstream != nil {
+		dns.resolvConfUpstream.SetNameservers(dns.otherNameservers())
+	}
+	if dns.coalesce {
+		dns.coalescer = upstream.NewCoalescer(dns.forwarder)
+		dns.forwarder = dns.coalescer
+	}
+	if dns.cacheConfig != nil {
+		cache := upstream.NewCache(dns.forwarder, *dns.cacheConfig)
+		cache.SetLogger(dns.log)
+		dns.forwarder = cache
+	}
+	return dns, nil
 }
 
-// NewEdgeDNS creates a new EdgeDNS instance
+// NewEdgeDNS creates a new EdgeDNS instance from the configuration
 func NewEdgeDNS(config *config.DNSConfig) (dns *EdgeDNS, err error) {
-	dns = &EdgeDNS{
-		ListenIP:            []byte{},
-		Server:              &mdns.Server{},
-		Exit:                make(chan interface{}),
-		Feed:                feed.NewK8sAPI(config.Feed),
-		UpdateResolvConf:    config.UpdateResolvConf,
-		ResolvConf:          config.ResolvConf,
-		RemoveSearchDomains: config.RemoveSearchDomains,
+	feeds, err := feed.NewRegistryFromConfig(config.Feed)
+	if err != nil {
+		return nil, err
 	}
 
 	// get dns listen ip
+	listenHost := ""
 	if config.ListenInterface != "" {
-		dns.ListenIP, err = getInterfaceIP(config.ListenInterface)
+		listenIP, err := getInterfaceIP(config.ListenInterface)
 		if err != nil {
-			return dns, fmt.Errorf("get dns listen ip for interface %s err: %v", config.ListenInterface, err)
+			return nil, fmt.Errorf("get dns listen ip for interface %s err: %v", config.ListenInterface, err)
 		}
-	} else {
-		dns.ListenIP = nil
-		klog.Info("no listen interface provided. Proxy mode only.")
+		listenHost = listenIP.String()
 	}
-	otherNameservers = dns.otherNameservers()
-
-	addr := fmt.Sprintf("%v:%v", dns.ListenIP, config.ListenPort)
-	dns.Server = &mdns.Server{Addr: addr, Net: "udp"}
 
+	opts := []Option{
+		WithListenAddress(net.JoinHostPort(listenHost, strconv.Itoa(config.ListenPort))),
+		WithFeeds(feeds),
+		WithZone(config.Zone),
+		WithResolvConf(config.ResolvConf, config.UpdateResolvConf, config.RemoveSearchDomains),
+		WithUpstream(config.Upstream),
+	}
+	if config.Upstream.Coalesce {
+		opts = append(opts, WithCoalescing())
+	}
+	if config.Upstream.Cache.Enabled {
+		opts = append(opts, WithCache(config.Upstream.Cache))
+	}
+	if (config.Feed.K8sapi.Enabled && config.Feed.K8sapi.Compat) || config.Feed.Services.Enabled {
+		opts = append(opts, WithClusterDomain(config.Feed.ClusterDomain))
+	}
+	dns, err = New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if config.ListenInterface == "" {
+		dns.log.Infof("no listen interface provided. Proxy mode only.")
+	}
 	return dns, nil
 }
 
-// getInterfaceIP get net interface IPv4 address
+// Close releases the resources of the feeds, e.g. the connection to the container runtime.
+// It must be called after Run returned, the instance can't be run again afterwards.
+func (dns *EdgeDNS) Close() error {
+	return dns.Feeds.Close()
+}
+
+// UpstreamStats returns how many queries were forwarded and how many were coalesced with an identical
+// query in flight. Both are 0 if coalescing is disabled.
+func (dns *EdgeDNS) UpstreamStats() upstream.CoalescerStats {
+	if dns.coalescer == nil {
+		return upstream.CoalescerStats{}
+	}
+	return dns.coalescer.Stats()
+}
+
+// getInterfaceIP get net interface IP address. IPv4 addresses are preferred,
+// otherwise the first global unicast IPv6 address is used.
 func getInterfaceIP(name string) (net.IP, error) {
 	ifi, err := net.InterfaceByName(name)
 	if err != nil {
 		return nil, err
 	}
 	addrs, _ := ifi.Addrs()
+	var ip6 net.IP
 	for _, addr := range addrs {
-		if ip, ipn, _ := net.ParseCIDR(addr.String()); len(ipn.Mask) == 4 {
-			return ip, nil
+		ip, _, err := net.ParseCIDR(addr.String())
+		if err != nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4, nil
 		}
+		if ip6 == nil && ip.IsGlobalUnicast() {
+			ip6 = ip
+		}
+	}
+	if ip6 != nil {
+		return ip6, nil
 	}
-	return nil, fmt.Errorf("no ip of version 4 found for interface %s", name)
+	return nil, fmt.Errorf("no usable ip found for interface %s", name)
 }
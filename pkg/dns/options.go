@@ -0,0 +1,224 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/edgefarm/node-dns/pkg/feed"
+	"github.com/edgefarm/node-dns/pkg/records"
+	"github.com/edgefarm/node-dns/pkg/upstream"
+	upstreamconfig "github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+// Forwarder resolves the queries that are not answered from the local records
+type Forwarder interface {
+	Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error)
+}
+
+// Logger is used by EdgeDNS, its feeds and its upstream forwarders for all of their log output.
+// Loggers that implement Debugf(format string, args ...interface{}) receive the verbose messages as well.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// klogLogger is the default Logger
+type klogLogger struct{}
+
+func (klogLogger) Infof(format string, args ...interface{}) {
+	klog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Warningf(format string, args ...interface{}) {
+	klog.WarningDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Errorf(format string, args ...interface{}) {
+	klog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Debugf(format string, args ...interface{}) {
+	if klog.V(2).Enabled() {
+		klog.InfoDepth(1, fmt.Sprintf(format, args...))
+	}
+}
+
+// Option configures an EdgeDNS instance
+type Option func(dns *EdgeDNS) error
+
+// WithListenAddress sets the address the UDP and TCP servers listen on, e.g. '127.0.0.1:53'
+func WithListenAddress(addr string) Option {
+	return func(dns *EdgeDNS) error {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("invalid listen address %s: %v", addr, err)
+		}
+		dns.ListenAddr = addr
+		dns.ListenIP = net.ParseIP(host)
+		return nil
+	}
+}
+
+// WithListeners makes the servers use already bound sockets instead of listening themselves
+func WithListeners(packetConn net.PacketConn, listener net.Listener) Option {
+	return func(dns *EdgeDNS) error {
+		if packetConn == nil || listener == nil {
+			return fmt.Errorf("both, the packet conn and the listener are needed")
+		}
+		dns.packetConn = packetConn
+		dns.listener = listener
+		return nil
+	}
+}
+
+// WithFeed adds a feed to the feed registry
+func WithFeed(name string, priority int, f feed.If) Option {
+	return func(dns *EdgeDNS) error {
+		dns.Feeds.Register(name, priority, f)
+		return nil
+	}
+}
+
+// WithFeeds replaces the feed registry
+func WithFeeds(feeds *feed.Registry) Option {
+	return func(dns *EdgeDNS) error {
+		dns.Feeds = feeds
+		return nil
+	}
+}
+
+// WithRecordStore sets the store the records of the feeds are kept in
+func WithRecordStore(store *records.Store) Option {
+	return func(dns *EdgeDNS) error {
+		dns.Records = store
+		return nil
+	}
+}
+
+// WithForwarder sets the forwarder for queries that are not answered locally.
+// The nameservers of resolv.conf are not used anymore then.
+func WithForwarder(forwarder Forwarder) Option {
+	return func(dns *EdgeDNS) error {
+		dns.forwarder = forwarder
+		dns.upstreams = nil
+		dns.resolvConfUpstream = nil
+		return nil
+	}
+}
+
+// WithUpstream configures the default forwarder: its strategy, timeouts, health checks and forwarding
+// zones. If the configuration contains nameservers, they are used instead of the nameservers of resolv.conf.
+func WithUpstream(config *upstreamconfig.UpstreamConfig) Option {
+	return func(dns *EdgeDNS) error {
+		forwarder, err := upstream.NewForwarderFromConfig(config)
+		if err != nil {
+			return err
+		}
+		dns.forwarder = forwarder
+		dns.upstreams = []*upstream.Forwarder{forwarder}
+		dns.resolvConfUpstream = nil
+		if len(config.Nameservers) == 0 {
+			dns.resolvConfUpstream = forwarder
+		}
+		if len(config.Zones) == 0 {
+			return nil
+		}
+
+		router := upstream.NewRouter(forwarder)
+		for _, zone := range config.Zones {
+			if zone.NoForward {
+				router.Add(zone.Domain, nil)
+				continue
+			}
+			if len(zone.Nameservers) == 0 {
+				return fmt.Errorf("forwarding zone %s has no nameservers", zone.Domain)
+			}
+			zoneConfig := *config
+			zoneConfig.Nameservers = zone.Nameservers
+			if zone.Strategy != "" {
+				zoneConfig.Strategy = zone.Strategy
+			}
+			zoneForwarder, err := upstream.NewForwarderFromConfig(&zoneConfig)
+			if err != nil {
+				return fmt.Errorf("forwarding zone %s: %v", zone.Domain, err)
+			}
+			router.Add(zone.Domain, zoneForwarder)
+			dns.upstreams = append(dns.upstreams, zoneForwarder)
+		}
+		dns.forwarder = router
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the instance, which is passed to its feeds and upstream forwarders as well
+func WithLogger(log Logger) Option {
+	return func(dns *EdgeDNS) error {
+		dns.log = log
+		return nil
+	}
+}
+
+// WithZone sets the local zone node-dns is authoritative for. An empty name disables the zone.
+func WithZone(name string) Option {
+	return func(dns *EdgeDNS) error {
+		dns.Zone = newZone(name)
+		return nil
+	}
+}
+
+// WithClusterDomain makes node-dns authoritative for the Kubernetes cluster domain as well. Names of the
+// cluster domain are looked up as they are, unknown names are answered with NXDOMAIN instead of being forwarded.
+func WithClusterDomain(name string) Option {
+	return func(dns *EdgeDNS) error {
+		dns.ClusterZone = newZone(name)
+		return nil
+	}
+}
+
+// WithCoalescing passes only one of several identical queries in flight to the forwarder.
+// It applies to the forwarder set by the other options.
+func WithCoalescing() Option {
+	return func(dns *EdgeDNS) error {
+		dns.coalesce = true
+		return nil
+	}
+}
+
+// WithCache caches the answers of the forwarder. It applies to the forwarder set by the other options.
+func WithCache(config upstreamconfig.CacheConfig) Option {
+	return func(dns *EdgeDNS) error {
+		dns.cacheConfig = &config
+		return nil
+	}
+}
+
+// WithResolvConf sets the resolv.conf to read the other nameservers from. If update is set,
+// the own address is added to it while running and search domains are removed if requested.
+func WithResolvConf(path string, update bool, removeSearchDomains bool) Option {
+	return func(dns *EdgeDNS) error {
+		dns.ResolvConf = path
+		dns.UpdateResolvConf = update
+		dns.RemoveSearchDomains = removeSearchDomains
+		return nil
+	}
+}
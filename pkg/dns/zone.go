@@ -0,0 +1,88 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package dns
+
+import (
+	"strings"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+const (
+	// recordTTL is the TTL of all locally served records
+	recordTTL = 60
+	// negativeTTL is the time clients are allowed to cache negative answers (RFC 2308)
+	negativeTTL = 30
+)
+
+// zone is the local zone node-dns is authoritative for
+type zone struct {
+	// origin is the fully qualified, lower case name of the zone
+	origin string
+	serial uint32
+}
+
+// newZone creates a new zone. An empty name disables the zone.
+func newZone(name string) *zone {
+	name = strings.Trim(strings.ToLower(name), ".")
+	if name == "" {
+		return nil
+	}
+	return &zone{
+		origin: mdns.Fqdn(name),
+		serial: uint32(time.Now().Unix()),
+	}
+}
+
+// relative returns the name without the zone suffix and whether the name is part of the zone.
+// Names outside of the zone are returned without the trailing dot.
+func (z *zone) relative(name string) (string, bool) {
+	name = strings.ToLower(mdns.Fqdn(name))
+	if z == nil || !mdns.IsSubDomain(z.origin, name) {
+		return strings.TrimSuffix(name, "."), false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(name, z.origin), "."), true
+}
+
+// contains reports whether the name is part of the zone
+func (z *zone) contains(name string) bool {
+	return z != nil && mdns.IsSubDomain(z.origin, strings.ToLower(mdns.Fqdn(name)))
+}
+
+// qualify returns the fully qualified name of a local name, within the zone if requested.
+// Names with a trailing dot are already fully qualified and returned as they are.
+func (z *zone) qualify(name string, inZone bool) string {
+	if z == nil || !inZone || strings.HasSuffix(name, ".") {
+		return mdns.Fqdn(name)
+	}
+	return mdns.Fqdn(name) + z.origin
+}
+
+// soa returns the SOA record of the zone, which is sent along with negative answers
+func (z *zone) soa() mdns.RR {
+	return &mdns.SOA{
+		Hdr:     mdns.RR_Header{Name: z.origin, Rrtype: mdns.TypeSOA, Class: mdns.ClassINET, Ttl: negativeTTL},
+		Ns:      "ns." + z.origin,
+		Mbox:    "hostmaster." + z.origin,
+		Serial:  z.serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  negativeTTL,
+	}
+}
@@ -16,10 +16,36 @@ limitations under the License.
 
 package config
 
+import "time"
+
+const (
+	// ConflictFirstWins keeps a name with the feed that published it first
+	ConflictFirstWins = "first-wins"
+	// ConflictHighestPriorityWins uses the addresses of the feed with the highest priority
+	ConflictHighestPriorityWins = "highest-priority-wins"
+	// ConflictAllAddresses returns the addresses of all feeds publishing a name
+	ConflictAllAddresses = "all-addresses"
+)
+
 // FeedConfig specifies the feed config
 type FeedConfig struct {
+	// ConflictPolicy defines how names published by more than one feed are resolved.
+	// One of first-wins, highest-priority-wins, all-addresses
+	// default: highest-priority-wins
+	ConflictPolicy string `json:"conflictPolicy"`
+	// ClusterDomain is the domain of the Kubernetes cluster used by the Kubernetes compatible names
+	// default: cluster.local
+	ClusterDomain string `json:"clusterDomain"`
 	// K8sapi configures the k8s api feed
 	K8sapi K8sAPIConfig
+	// Services configures the k8s services feed
+	Services ServicesConfig
+	// Docker configures the docker engine feed
+	Docker DockerConfig
+	// CRI configures the container runtime interface feed
+	CRI CRIConfig
+	// Static configures the static records feed
+	Static StaticConfig
 }
 
 // K8sAPIConfig specifies the k8s api feed configuration
@@ -27,6 +53,9 @@ type K8sAPIConfig struct {
 	// Enabled indicates if the k8s api feed is used
 	// default: false
 	Enabled bool `json:"enabled"`
+	// Priority of the feed, feeds with a higher priority win conflicts
+	// default: 30
+	Priority int `json:"priority"`
 	// URI is where the api server is reacheble. Format: 'host:port', optional with 'http://' or 'https://'
 	// default: http://127.0.0.1:10550
 	URI string `json:"URI"`
@@ -36,16 +65,145 @@ type K8sAPIConfig struct {
 	// Token is the token to communicate with the API server (optional)
 	// default: ""
 	Token string `json:"token"`
+	// NodeName is the name of the node node-dns runs on. Only pods scheduled to this node are used.
+	// If empty, the environment variable NODE_NAME (e.g. set using the Downward API) or the hostname is used.
+	// default: ""
+	NodeName string `json:"nodeName"`
+	// Watch indicates if pod changes are watched. If disabled, the pods are polled every 30 seconds.
+	// default: true
+	Watch bool `json:"watch"`
+	// LabelKey is the label or annotation that marks the pods to be published. Its value is available as .Pod in the name templates.
+	// default: node-dns.host
+	LabelKey string `json:"labelKey"`
+	// NameTemplates are Go templates of the names published for each container. Available are .Container, .Pod,
+	// .PodName, .Namespace, .Hostname, .Labels and .Annotations
+	// default: ["{{.Container}}.{{.Pod}}"]
+	NameTemplates []string `json:"nameTemplates"`
+	// Compat publishes the names of the Kubernetes DNS specification for all pods on this node,
+	// <a-b-c-d>.<namespace>.pod.<clusterDomain> and <hostname>.<subdomain>.<namespace>.svc.<clusterDomain>
+	// default: false
+	Compat bool `json:"compat"`
+	// ReadyOnly restricts the published containers to the ready containers of running pods. Containers without
+	// status use the pods Ready condition.
+	// default: true
+	ReadyOnly bool `json:"readyOnly"`
+	// GracePeriod keeps the records of deleted and terminating pods for a while to avoid flapping names
+	// default: 5s
+	GracePeriod time.Duration `json:"gracePeriod"`
+}
+
+// ServicesConfig specifies the k8s services feed configuration. The feed uses the API server and
+// node name of the k8s api feed configuration.
+type ServicesConfig struct {
+	// Enabled indicates if the k8s services feed is used
+	// default: false
+	Enabled bool `json:"enabled"`
+	// Priority of the feed, feeds with a higher priority win conflicts
+	// default: 25
+	Priority int `json:"priority"`
+	// ClusterIPFallback resolves services without ready endpoints on this node to their cluster IPs
+	// default: false
+	ClusterIPFallback bool `json:"clusterIPFallback"`
+}
+
+// DockerConfig specifies the docker engine feed configuration
+type DockerConfig struct {
+	// Enabled indicates if the docker feed is used
+	// default: false
+	Enabled bool `json:"enabled"`
+	// Priority of the feed, feeds with a higher priority win conflicts
+	// default: 10
+	Priority int `json:"priority"`
+	// Socket is the unix socket of the docker engine API
+	// default: /var/run/docker.sock
+	Socket string `json:"socket"`
+	// Label is the container label whose value is used for '<containerName>.<value>' names
+	// default: node-dns.host
+	Label string `json:"label"`
+}
+
+// CRIConfig specifies the container runtime interface feed configuration
+type CRIConfig struct {
+	// Enabled indicates if the cri feed is used
+	// default: false
+	Enabled bool `json:"enabled"`
+	// Priority of the feed, feeds with a higher priority win conflicts
+	// default: 20
+	Priority int `json:"priority"`
+	// Endpoint is the unix socket of the CRI runtime service
+	// default: /run/containerd/containerd.sock
+	Endpoint string `json:"endpoint"`
+	// Label is the pod label whose value is used for '<containerName>.<value>' names
+	// default: node-dns.host
+	Label string `json:"label"`
+}
+
+// StaticConfig specifies the static records feed configuration
+type StaticConfig struct {
+	// Enabled indicates if the static records feed is used
+	// default: false
+	Enabled bool `json:"enabled"`
+	// Priority of the feed, feeds with a higher priority win conflicts
+	// default: 40
+	Priority int `json:"priority"`
+	// Records are static records defined in the configuration
+	// default: []
+	Records []StaticRecord `json:"records"`
+	// Files are hosts files or YAML files (.yaml, .yml) containing a list of records.
+	// They are reloaded as soon as they change.
+	// default: []
+	Files []string `json:"files"`
+}
+
+// StaticRecord is a name with its addresses
+type StaticRecord struct {
+	// Name is the name to resolve
+	Name string `json:"name"`
+	// Addresses are the IPv4 and IPv6 addresses of the name
+	Addresses []string `json:"addresses"`
 }
 
 // NewFeedConfig returns a default FeedConfig
 func NewFeedConfig() *FeedConfig {
 	return &FeedConfig{
+		ConflictPolicy: ConflictHighestPriorityWins,
+		ClusterDomain:  "cluster.local",
 		K8sapi: K8sAPIConfig{
-			Enabled:     true,
-			URI:         "http://127.0.0.1:10550",
-			InsecureTLS: true,
-			Token:       "",
+			Enabled:       true,
+			Priority:      30,
+			URI:           "http://127.0.0.1:10550",
+			InsecureTLS:   true,
+			Token:         "",
+			NodeName:      "",
+			Watch:         true,
+			LabelKey:      "node-dns.host",
+			NameTemplates: []string{"{{.Container}}.{{.Pod}}"},
+			Compat:        false,
+			ReadyOnly:     true,
+			GracePeriod:   5 * time.Second,
+		},
+		Services: ServicesConfig{
+			Enabled:           false,
+			Priority:          25,
+			ClusterIPFallback: false,
+		},
+		Docker: DockerConfig{
+			Enabled:  false,
+			Priority: 10,
+			Socket:   "/var/run/docker.sock",
+			Label:    "node-dns.host",
+		},
+		CRI: CRIConfig{
+			Enabled:  false,
+			Priority: 20,
+			Endpoint: "/run/containerd/containerd.sock",
+			Label:    "node-dns.host",
+		},
+		Static: StaticConfig{
+			Enabled:  false,
+			Priority: 40,
+			Records:  []StaticRecord{},
+			Files:    []string{},
 		},
 	}
 }
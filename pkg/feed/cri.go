@@ -0,0 +1,155 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+const (
+	// criTimeout limits the time of each call to the container runtime
+	criTimeout = 10 * time.Second
+)
+
+// CRI defines the container runtime interface feed
+type CRI struct {
+	Feed
+	Endpoint string
+	Label    string
+
+	conn   *grpc.ClientConn
+	client runtimeapi.RuntimeServiceClient
+}
+
+// NewCRI creates a new feed using the CRI runtime service of the container runtime
+func NewCRI(config *config.FeedConfig) (*CRI, error) {
+	// the connection is established lazily, so a runtime that is not yet up is no error here
+	conn, err := grpc.Dial("unix://"+config.CRI.Endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to cri endpoint %s: %v", config.CRI.Endpoint, err)
+	}
+	return &CRI{
+		Endpoint: config.CRI.Endpoint,
+		Label:    config.CRI.Label,
+		Feed: Feed{
+			FeedDNSMap: make(map[string][]string),
+		},
+		conn:   conn,
+		client: runtimeapi.NewRuntimeServiceClient(conn),
+	}, nil
+}
+
+// Update triggers an update of the DNS cache
+func (c *CRI) Update(ctx context.Context) error {
+	c.logger().Infof("Updating DNS cache")
+	ctx, cancel := context.WithTimeout(ctx, criTimeout)
+	defer cancel()
+	podIPs, err := c.getPodIPs(ctx)
+	if err != nil {
+		return err
+	}
+	c.Feed.setDNSMap(podIPs)
+	return nil
+}
+
+// GetDNSMap returns the feeds DNS map
+func (c *CRI) GetDNSMap() map[string][]string {
+	return c.Feed.dnsMap()
+}
+
+// Close closes the connection to the container runtime
+func (c *CRI) Close() error {
+	return c.conn.Close()
+}
+
+// getPodIPs builds the '<container>.<pod>' names of all running containers in ready
+// pod sandboxes that have the label. The kubelet copies the pod labels to the sandbox.
+func (c *CRI) getPodIPs(ctx context.Context) (map[string][]string, error) {
+	sandboxes, err := c.client.ListPodSandbox(ctx, &runtimeapi.ListPodSandboxRequest{
+		Filter: &runtimeapi.PodSandboxFilter{
+			State: &runtimeapi.PodSandboxStateValue{State: runtimeapi.PodSandboxState_SANDBOX_READY},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pod sandboxes: %v", err)
+	}
+	containers, err := c.client.ListContainers(ctx, &runtimeapi.ListContainersRequest{
+		Filter: &runtimeapi.ContainerFilter{
+			State: &runtimeapi.ContainerStateValue{State: runtimeapi.ContainerState_CONTAINER_RUNNING},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %v", err)
+	}
+	containerNames := map[string][]string{}
+	for _, container := range containers.Containers {
+		if container.Metadata != nil {
+			containerNames[container.PodSandboxId] = append(containerNames[container.PodSandboxId], container.Metadata.Name)
+		}
+	}
+
+	podIPs := map[string][]string{}
+	for _, sandbox := range sandboxes.Items {
+		podName, ok := sandbox.Labels[c.Label]
+		if !ok {
+			continue
+		}
+		sandboxStatus, err := c.client.PodSandboxStatus(ctx, &runtimeapi.PodSandboxStatusRequest{PodSandboxId: sandbox.Id})
+		if status.Code(err) == codes.NotFound {
+			// the sandbox has been removed since it was listed
+			debugf(c.logger(), "pod sandbox %s is gone, skipping it", sandbox.Id)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get status of pod sandbox %s: %v", sandbox.Id, err)
+		}
+		ips := getSandboxAddresses(sandboxStatus.Status)
+		if len(ips) == 0 {
+			continue
+		}
+		for _, containerName := range containerNames[sandbox.Id] {
+			podIPs[fmt.Sprintf("%s.%s", containerName, podName)] = ips
+		}
+	}
+	return podIPs, nil
+}
+
+// getSandboxAddresses returns all addresses of a pod sandbox
+func getSandboxAddresses(status *runtimeapi.PodSandboxStatus) []string {
+	ips := []string{}
+	if status == nil || status.Network == nil {
+		return ips
+	}
+	if status.Network.Ip != "" {
+		ips = append(ips, status.Network.Ip)
+	}
+	for _, podIP := range status.Network.AdditionalIps {
+		if podIP.Ip != "" && !contains(ips, podIP.Ip) {
+			ips = append(ips, podIP.Ip)
+		}
+	}
+	return ips
+}
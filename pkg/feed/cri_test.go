@@ -0,0 +1,120 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// fakeRuntimeService serves a fixed set of pod sandboxes and containers
+type fakeRuntimeService struct {
+	runtimeapi.UnimplementedRuntimeServiceServer
+	sandboxes  []*runtimeapi.PodSandbox
+	statuses   map[string]*runtimeapi.PodSandboxStatus
+	containers []*runtimeapi.Container
+	// unavailable makes the status calls fail like a restarting runtime
+	unavailable bool
+}
+
+func (f *fakeRuntimeService) ListPodSandbox(ctx context.Context, req *runtimeapi.ListPodSandboxRequest) (*runtimeapi.ListPodSandboxResponse, error) {
+	return &runtimeapi.ListPodSandboxResponse{Items: f.sandboxes}, nil
+}
+
+func (f *fakeRuntimeService) PodSandboxStatus(ctx context.Context, req *runtimeapi.PodSandboxStatusRequest) (*runtimeapi.PodSandboxStatusResponse, error) {
+	if f.unavailable {
+		return nil, status.Error(codes.Unavailable, "runtime is restarting")
+	}
+	sandboxStatus, ok := f.statuses[req.PodSandboxId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "pod sandbox %s not found", req.PodSandboxId)
+	}
+	return &runtimeapi.PodSandboxStatusResponse{Status: sandboxStatus}, nil
+}
+
+func (f *fakeRuntimeService) ListContainers(ctx context.Context, req *runtimeapi.ListContainersRequest) (*runtimeapi.ListContainersResponse, error) {
+	return &runtimeapi.ListContainersResponse{Containers: f.containers}, nil
+}
+
+// startTestCRIServer serves the runtime service on a unix socket
+func startTestCRIServer(t *testing.T, service runtimeapi.RuntimeServiceServer) string {
+	socket := filepath.Join(t.TempDir(), "cri.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, service)
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(server.Stop)
+	return socket
+}
+
+func TestCRIUpdate(t *testing.T) {
+	assert := assert.New(t)
+	service := &fakeRuntimeService{
+		sandboxes: []*runtimeapi.PodSandbox{
+			{Id: "pod1", Labels: map[string]string{"node-dns.host": "mypod"}},
+			{Id: "pod2", Labels: map[string]string{"app": "unlabelled"}},
+			{Id: "pod3", Labels: map[string]string{"node-dns.host": "hostnetwork"}},
+			// removed between listing the sandboxes and getting their status
+			{Id: "pod4", Labels: map[string]string{"node-dns.host": "removed"}},
+		},
+		statuses: map[string]*runtimeapi.PodSandboxStatus{
+			"pod1": {Network: &runtimeapi.PodSandboxNetworkStatus{
+				Ip:            "10.88.0.2",
+				AdditionalIps: []*runtimeapi.PodIP{{Ip: "fd00::2"}},
+			}},
+			"pod3": {Network: &runtimeapi.PodSandboxNetworkStatus{}},
+		},
+		containers: []*runtimeapi.Container{
+			{PodSandboxId: "pod1", Metadata: &runtimeapi.ContainerMetadata{Name: "nginx"}},
+			{PodSandboxId: "pod1", Metadata: &runtimeapi.ContainerMetadata{Name: "sidecar"}},
+			{PodSandboxId: "pod2", Metadata: &runtimeapi.ContainerMetadata{Name: "other"}},
+			{PodSandboxId: "pod3", Metadata: &runtimeapi.ContainerMetadata{Name: "agent"}},
+			{PodSandboxId: "pod4", Metadata: &runtimeapi.ContainerMetadata{Name: "nginx"}},
+		},
+	}
+	cfg := config.NewFeedConfig()
+	cfg.CRI.Enabled = true
+	cfg.CRI.Endpoint = startTestCRIServer(t, service)
+	c, err := NewCRI(cfg)
+	assert.Nil(err)
+
+	assert.Nil(c.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"nginx.mypod":   {"10.88.0.2", "fd00::2"},
+		"sidecar.mypod": {"10.88.0.2", "fd00::2"},
+	}, c.GetDNSMap())
+
+	// other errors keep the previous records
+	service.unavailable = true
+	assert.NotNil(c.Update(context.Background()))
+	assert.Len(c.GetDNSMap(), 2)
+
+	assert.Nil(c.Close())
+	assert.NotNil(c.Update(context.Background()))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/edgefarm/node-dns/pkg/records"
+	mdns "github.com/miekg/dns"
+)
+
+// servicesName is used to enumerate all service types, see RFC 6763 section 9
+const servicesName = "_services._dns-sd._udp"
+
+// serviceInstance is an instance of a service that can be browsed using DNS-SD (RFC 6763)
+type serviceInstance struct {
+	// Instance is the name of the instance, e.g. nginx-mypod
+	Instance string
+	// Service is the port name, e.g. http
+	Service string
+	// Protocol is tcp or udp
+	Protocol string
+	// Target is the name of the address records, e.g. nginx.mypod
+	Target string
+	Port   uint16
+	// Text contains the key/value pairs of the TXT record
+	Text []string
+}
+
+// records creates the browse records of the service type, the instance PTR record
+// and the instance SRV and TXT records
+func (s serviceInstance) records() []records.Record {
+	serviceType := fmt.Sprintf("_%s._%s", s.Service, s.Protocol)
+	instance := fmt.Sprintf("%s.%s", strings.ReplaceAll(s.Instance, ".", "-"), serviceType)
+	text := s.Text
+	if len(text) == 0 {
+		// every instance has a TXT record, if there is nothing to say it contains a single empty string
+		text = []string{""}
+	}
+	return []records.Record{
+		{Name: servicesName, Type: mdns.TypePTR, Target: serviceType},
+		{Name: serviceType, Type: mdns.TypePTR, Target: instance},
+		{Name: instance, Type: mdns.TypeSRV, Target: s.Target, Port: s.Port, Weight: 100},
+		{Name: instance, Type: mdns.TypeTXT, Text: text},
+	}
+}
+
+// splitList splits a comma separated list, e.g. "path=/,version=1"
+func splitList(value string) []string {
+	text := []string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair != "" {
+			text = append(text, pair)
+		}
+	}
+	return text
+}
+
+// dnssdProtocol returns the protocol label used by DNS-SD, which is udp for everything except tcp
+func dnssdProtocol(protocol string) string {
+	if strings.EqualFold(protocol, "tcp") {
+		return "tcp"
+	}
+	return "udp"
+}
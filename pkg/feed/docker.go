@@ -0,0 +1,247 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+)
+
+const (
+	containersAPI = "/containers/json"
+	eventsAPI     = "/events"
+
+	composeServiceLabel = "com.docker.compose.service"
+	composeProjectLabel = "com.docker.compose.project"
+)
+
+// Docker defines the docker engine feed
+type Docker struct {
+	Feed
+	Socket string
+	Label  string
+
+	client *http.Client
+}
+
+// dockerContainer is the part of a container of the engine API the feed uses
+type dockerContainer struct {
+	ID              string            `json:"Id"`
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// NewDocker creates a new feed using the docker engine API
+func NewDocker(config *config.FeedConfig) *Docker {
+	socket := config.Docker.Socket
+	return &Docker{
+		Socket: socket,
+		Label:  config.Docker.Label,
+		Feed: Feed{
+			FeedDNSMap: make(map[string][]string),
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					d := net.Dialer{}
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Update triggers an update of the DNS cache
+func (d *Docker) Update(ctx context.Context) error {
+	d.logger().Infof("Updating DNS cache")
+	containers, err := d.getContainers(ctx)
+	if err != nil {
+		return err
+	}
+	d.Feed.setDNSMap(d.getContainerIPs(containers))
+	return nil
+}
+
+// GetDNSMap returns the feeds DNS map
+func (d *Docker) GetDNSMap() map[string][]string {
+	return d.Feed.dnsMap()
+}
+
+// Watch follows the container events and updates the DNS map on each of them until stop is closed.
+// Broken connections are reestablished.
+func (d *Docker) Watch(stop <-chan struct{}, changed func()) {
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	backoff := minBackoff
+	for {
+		err := d.followEvents(ctx, changed, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		d.logger().Errorf("following docker events failed, reconnecting in %v, err: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// followEvents subscribes to the container and network events and updates the DNS map after each of them.
+// The subscription is made before listing the containers, so no change gets lost in between.
+func (d *Docker) followEvents(ctx context.Context, changed func(), connected func()) error {
+	filters, err := json.Marshal(map[string][]string{"type": {"container", "network"}})
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("filters", string(filters))
+	resp, err := d.get(ctx, eventsAPI, query)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	connected()
+
+	if err := d.Update(ctx); err != nil {
+		return err
+	}
+	changed()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := struct {
+			Type   string `json:"Type"`
+			Action string `json:"Action"`
+		}{}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return fmt.Errorf("event stream closed")
+			}
+			return err
+		}
+		debugf(d.logger(), "docker event %s %s", event.Type, event.Action)
+		if err := d.Update(ctx); err != nil {
+			return err
+		}
+		changed()
+	}
+}
+
+// getContainerIPs extracts the names and IPs of the containers
+func (d *Docker) getContainerIPs(containers []dockerContainer) map[string][]string {
+	containerIPs := map[string][]string{}
+	for _, container := range containers {
+		ips := []string{}
+		for _, network := range container.NetworkSettings.Networks {
+			for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+				if ip != "" && !contains(ips, ip) {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		for _, name := range d.getContainerNames(container) {
+			containerIPs[name] = ips
+		}
+	}
+	return containerIPs
+}
+
+// getContainerNames returns the container name, '<service>.<project>' for compose services
+// and '<name>.<value>' if the container has the configured label
+func (d *Docker) getContainerNames(container dockerContainer) []string {
+	names := []string{}
+	containerName := ""
+	if len(container.Names) > 0 {
+		containerName = strings.TrimPrefix(container.Names[0], "/")
+		names = append(names, containerName)
+	}
+	service, hasService := container.Labels[composeServiceLabel]
+	project, hasProject := container.Labels[composeProjectLabel]
+	if hasService && hasProject {
+		names = append(names, fmt.Sprintf("%s.%s", service, project))
+	}
+	if value, ok := container.Labels[d.Label]; ok && d.Label != "" && containerName != "" {
+		names = append(names, fmt.Sprintf("%s.%s", containerName, value))
+	}
+	return names
+}
+
+// getContainers gets all running containers from the docker engine
+func (d *Docker) getContainers(ctx context.Context) ([]dockerContainer, error) {
+	resp, err := d.get(ctx, containersAPI, url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	containers := []dockerContainer{}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// get sends a GET request to the docker engine
+func (d *Docker) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request %s failed: %s", path, resp.Status)
+	}
+	return resp, nil
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
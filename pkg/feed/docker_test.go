@@ -0,0 +1,135 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const testContainers = `[
+  {
+    "Id": "1",
+    "Names": ["/web"],
+    "Labels": {"com.docker.compose.service": "web", "com.docker.compose.project": "shop", "node-dns.host": "frontend"},
+    "NetworkSettings": {"Networks": {
+      "bridge": {"IPAddress": "172.17.0.2", "GlobalIPv6Address": "fd00::2"},
+      "shop_default": {"IPAddress": "172.20.0.2", "GlobalIPv6Address": ""}
+    }}
+  },
+  {
+    "Id": "2",
+    "Names": ["/host-networked"],
+    "Labels": {},
+    "NetworkSettings": {"Networks": {"host": {"IPAddress": "", "GlobalIPv6Address": ""}}}
+  }
+]`
+
+// startTestDockerServer serves the given handler on a unix socket
+func startTestDockerServer(t *testing.T, handler http.Handler) string {
+	socket := filepath.Join(t.TempDir(), "docker.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: handler}
+	go func() { _ = server.Serve(l) }()
+	t.Cleanup(func() { server.Close() })
+	return socket
+}
+
+func newTestDocker(socket string) *Docker {
+	cfg := config.NewFeedConfig()
+	cfg.Docker.Enabled = true
+	cfg.Docker.Socket = socket
+	return NewDocker(cfg)
+}
+
+func TestDockerUpdate(t *testing.T) {
+	assert := assert.New(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc(containersAPI, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testContainers)
+	})
+	d := newTestDocker(startTestDockerServer(t, mux))
+
+	assert.Nil(d.Update(context.Background()))
+	dnsMap := d.GetDNSMap()
+	for _, name := range []string{"web", "web.shop", "web.frontend"} {
+		assert.Contains(dnsMap, name)
+		assert.ElementsMatch([]string{"172.17.0.2", "fd00::2", "172.20.0.2"}, dnsMap[name])
+	}
+	assert.NotContains(dnsMap, "host-networked")
+	assert.Len(dnsMap, 3)
+}
+
+func TestDockerWatch(t *testing.T) {
+	assert := assert.New(t)
+	started := make(chan struct{})
+	events := make(chan string)
+	mux := http.NewServeMux()
+	mux.HandleFunc(containersAPI, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-started:
+			fmt.Fprint(w, testContainers)
+		default:
+			fmt.Fprint(w, "[]")
+		}
+	})
+	mux.HandleFunc(eventsAPI, func(w http.ResponseWriter, r *http.Request) {
+		assert.Contains(r.URL.Query().Get("filters"), "container")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				fmt.Fprintln(w, event)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	d := newTestDocker(startTestDockerServer(t, mux))
+
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go d.Watch(stop, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+		assert.Empty(d.GetDNSMap())
+	case <-time.After(time.Second):
+		t.Fatal("no initial update")
+	}
+	close(started)
+	events <- `{"Type":"container","Action":"start","Actor":{"ID":"1"}}`
+	select {
+	case <-changed:
+		assert.Contains(d.GetDNSMap(), "web.shop")
+	case <-time.After(time.Second):
+		t.Fatal("no update after event")
+	}
+}
@@ -16,14 +16,123 @@ limitations under the License.
 
 package feed
 
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/records"
+)
+
 // If is an interface to enable different sources to obtain of host/ip entries
 type If interface {
-	Update() error
-	GetDNSMap() map[string]string
+	// Update reads the source and replaces the DNS map. It returns as soon as the context is cancelled.
+	Update(ctx context.Context) error
+	GetDNSMap() map[string][]string
+}
+
+// Watcher is implemented by feeds that follow the changes of their source instead of being polled
+type Watcher interface {
+	// Watch keeps the DNS map up to date until stop is closed.
+	// changed is called every time the DNS map has been updated.
+	Watch(stop <-chan struct{}, changed func())
+}
+
+// RecordFeed is implemented by feeds that publish records besides addresses, e.g. SRV records
+type RecordFeed interface {
+	GetRecords() []records.Record
 }
 
 // Feed contains everything a feed uses
 type Feed struct {
 	// FeedDNSMap is a map of hostnames with their corresponding IP addresses
-	FeedDNSMap map[string]string
+	FeedDNSMap map[string][]string
+	// feedRecords are the records besides addresses
+	feedRecords []records.Record
+	mutex       sync.RWMutex
+	log         Logger
+}
+
+// SetLogger sets the logger of the feed. It must be called before the feed is used.
+func (f *Feed) SetLogger(log Logger) {
+	f.log = log
+}
+
+// logger returns the logger of the feed, klog unless another one has been set
+func (f *Feed) logger() Logger {
+	if f.log == nil {
+		return klogLogger{}
+	}
+	return f.log
+}
+
+// setDNSMap replaces the content of the DNS map
+func (f *Feed) setDNSMap(dnsMap map[string][]string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for k := range f.FeedDNSMap {
+		delete(f.FeedDNSMap, k)
+	}
+	for host, ips := range dnsMap {
+		f.FeedDNSMap[host] = ips
+	}
+}
+
+// dnsMap returns a copy of the DNS map that is safe to be used while the feed gets updated
+func (f *Feed) dnsMap() map[string][]string {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	dnsMap := make(map[string][]string, len(f.FeedDNSMap))
+	for host, ips := range f.FeedDNSMap {
+		dnsMap[host] = ips
+	}
+	return dnsMap
+}
+
+// setRecords replaces the records besides addresses
+func (f *Feed) setRecords(feedRecords []records.Record) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.feedRecords = feedRecords
+}
+
+// GetRecords returns the records besides addresses
+func (f *Feed) GetRecords() []records.Record {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return append([]records.Record{}, f.feedRecords...)
+}
+
+// Poll updates the feed every interval until stop is closed.
+// changed is called after every successful update, failed updates are logged.
+func Poll(f If, interval time.Duration, stop <-chan struct{}, changed func(), log Logger) {
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := f.Update(ctx); err != nil {
+			log.Errorf("failed to update feed, err: %v", err)
+		} else {
+			changed()
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopContext returns a context that is cancelled as soon as stop is closed
+func stopContext(stop <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
 }
@@ -17,19 +17,50 @@ limitations under the License.
 package feed
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/edgefarm/node-dns/pkg/records"
+	mdns "github.com/miekg/dns"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/klog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 const (
 	podsAPI = "/api/v1/pods"
+
+	// dnssdKey is the annotation or label that opts in to DNS-SD. Its value is either "true"
+	// for all containers of the pod or a comma separated list of container names.
+	dnssdKey = "node-dns/dns-sd"
+	// aliasesAnnotation contains a comma separated list of additional names of the pods addresses
+	aliasesAnnotation = "node-dns/aliases"
+	// cnameAnnotation contains a comma separated list of CNAME records, e.g. "api=backend.mypod"
+	cnameAnnotation = "node-dns/cname"
+	// txtAnnotation contains the key/value pairs of the DNS-SD TXT records, e.g. "path=/,version=1"
+	txtAnnotation = "node-dns/txt"
+
+	// pollInterval is used to update the DNS cache if watching is disabled
+	pollInterval = 30 * time.Second
+	// watchTimeout makes the API server close a watch after some time, it gets restarted afterwards
+	watchTimeout = 5 * time.Minute
+	// requestTimeout limits the time of the requests to the API server besides watches
+	requestTimeout = 30 * time.Second
+	// minBackoff and maxBackoff limit the time to wait before reconnecting after errors
+	minBackoff = time.Second
+	maxBackoff = 30 * time.Second
 )
 
 // K8sAPI defines the k8s api feed
@@ -38,84 +69,640 @@ type K8sAPI struct {
 	URI         string
 	Token       string
 	InsecureTLS bool
+	// NodeName restricts the feed to pods running on this node
+	NodeName string
+	// WatchPods enables following the pod changes instead of polling them
+	WatchPods bool
+	// LabelKey is the label or annotation that marks the pods to be published
+	LabelKey string
+	// NameTemplates create the names of each container
+	NameTemplates []*template.Template
+	// Compat enables the names of the Kubernetes DNS specification within ClusterDomain
+	Compat        bool
+	ClusterDomain string
+	// ReadyOnly restricts the published containers to the ready containers of running pods
+	ReadyOnly bool
+	// GracePeriod keeps the records of deleted and terminating pods for a while
+	GracePeriod time.Duration
+
+	client *http.Client
+	// pods contains the currently known pods while watching
+	pods      map[types.UID]*corev1.Pod
+	podsMutex sync.Mutex
+
+	// current is the latest list of pods
+	current *corev1.PodList
+	// published are the pods of the latest list that are published
+	published map[types.UID]*corev1.Pod
+	// lingering are the pods kept during the grace period after they were deleted or started terminating
+	lingering map[types.UID]lingeringPod
+	// expiry republishes the pods when the first lingering pod expires
+	expiry *time.Timer
+	// changed is called when lingering pods expired
+	changed      func()
+	publishMutex sync.Mutex
+}
+
+// lingeringPod is a deleted or terminating pod whose records are kept until the grace period is over
+type lingeringPod struct {
+	pod   *corev1.Pod
+	until time.Time
+}
+
+// watchEvent is a single event of a watch stream
+type watchEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// nameData is available in the name templates
+type nameData struct {
+	// Container is the name of the container
+	Container string
+	// Pod is the value of the label or annotation
+	Pod string
+	// PodName is the name of the pod
+	PodName   string
+	Namespace string
+	// Hostname is the hostname of the pod, which defaults to the pod name
+	Hostname    string
+	Labels      map[string]string
+	Annotations map[string]string
 }
 
 // NewK8sAPI creates a new feed using the k8s API
-func NewK8sAPI(config *config.FeedConfig) *K8sAPI {
-	klog.Info("Starting local k8s api feed")
-	return &K8sAPI{
-		URI:         config.K8sapi.URI,
-		Token:       config.K8sapi.Token,
-		InsecureTLS: config.K8sapi.InsecureTLS,
+func NewK8sAPI(config *config.FeedConfig) (*K8sAPI, error) {
+	templates := []*template.Template{}
+	for i, text := range config.K8sapi.NameTemplates {
+		tmpl, err := template.New(fmt.Sprintf("name%d", i)).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name template %q: %v", text, err)
+		}
+		templates = append(templates, tmpl)
+	}
+	if len(templates) == 0 {
+		return nil, fmt.Errorf("no name template configured")
+	}
+	k8s := &K8sAPI{
+		URI:           config.K8sapi.URI,
+		Token:         config.K8sapi.Token,
+		InsecureTLS:   config.K8sapi.InsecureTLS,
+		NodeName:      getNodeName(config.K8sapi.NodeName),
+		WatchPods:     config.K8sapi.Watch,
+		LabelKey:      config.K8sapi.LabelKey,
+		NameTemplates: templates,
+		Compat:        config.K8sapi.Compat,
+		ClusterDomain: strings.Trim(config.ClusterDomain, "."),
+		ReadyOnly:     config.K8sapi.ReadyOnly,
+		GracePeriod:   config.K8sapi.GracePeriod,
 		Feed: Feed{
-			FeedDNSMap: make(map[string]string),
+			FeedDNSMap: make(map[string][]string),
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.K8sapi.InsecureTLS},
+			},
+			// watches are closed by the API server after watchTimeout
+			Timeout: watchTimeout + requestTimeout,
 		},
+		pods:      make(map[types.UID]*corev1.Pod),
+		published: make(map[types.UID]*corev1.Pod),
+		lingering: make(map[types.UID]lingeringPod),
+	}
+	return k8s, nil
+}
+
+// getNodeName returns the configured node name, falling back to $NODE_NAME and the hostname.
+// If the hostname is unknown as well, the name is empty, which selects all nodes.
+func getNodeName(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	if nodeName := os.Getenv("NODE_NAME"); nodeName != "" {
+		return nodeName
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return hostname
+}
+
+// nodeDescription describes the nodes selected by the node name for the log
+func nodeDescription(nodeName string) string {
+	if nodeName == "" {
+		return "all nodes"
 	}
+	return fmt.Sprintf("node %q", nodeName)
 }
 
 // Update triggers an update of the DNS cache
-func (k8s *K8sAPI) Update() error {
-	klog.Info("Updating DNS cache")
-	podsRaw, err := k8s.getPods()
+func (k8s *K8sAPI) Update(ctx context.Context) error {
+	k8s.logger().Infof("Updating DNS cache")
+	podsRaw, err := k8s.getPods(ctx)
 	if err != nil {
 		return err
 	}
-	podIPs, err := k8s.getPodIPs(podsRaw)
+	return k8s.publish(podsRaw)
+}
+
+// GetDNSMap returns the feeds DNS map
+func (k8s *K8sAPI) GetDNSMap() map[string][]string {
+	return k8s.Feed.dnsMap()
+}
+
+// Watch lists the pods once and follows their changes afterwards until stop is closed.
+// Broken connections are reestablished. If watching is disabled, the pods are polled.
+func (k8s *K8sAPI) Watch(stop <-chan struct{}, changed func()) {
+	k8s.logger().Infof("k8s api feed uses pods of %s", nodeDescription(k8s.NodeName))
+	k8s.publishMutex.Lock()
+	k8s.changed = changed
+	k8s.publishMutex.Unlock()
+	defer func() {
+		k8s.publishMutex.Lock()
+		k8s.changed = nil
+		if k8s.expiry != nil {
+			k8s.expiry.Stop()
+		}
+		k8s.publishMutex.Unlock()
+	}()
+
+	if !k8s.WatchPods {
+		Poll(k8s, pollInterval, stop, changed, k8s.logger())
+		return
+	}
+	ctx, cancel := stopContext(stop)
+	defer cancel()
+
+	backoff := minBackoff
+	for {
+		err := k8s.listAndWatch(ctx, changed, func() { backoff = minBackoff })
+		if ctx.Err() != nil {
+			return
+		}
+		k8s.logger().Errorf("watching pods failed, reconnecting in %v, err: %v", backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// listAndWatch lists all pods and follows their changes starting from the resource version of the list.
+// connected is called as soon as a watch has been established.
+func (k8s *K8sAPI) listAndWatch(ctx context.Context, changed func(), connected func()) error {
+	podlist, err := k8s.getPods(ctx)
 	if err != nil {
 		return err
 	}
+	k8s.podsMutex.Lock()
+	k8s.pods = make(map[types.UID]*corev1.Pod, len(podlist.Items))
+	for i := range podlist.Items {
+		k8s.pods[podlist.Items[i].UID] = &podlist.Items[i]
+	}
+	k8s.podsMutex.Unlock()
+	if err := k8s.updateFromPods(); err != nil {
+		return err
+	}
+	changed()
+
+	resourceVersion := podlist.ResourceVersion
+	for {
+		resourceVersion, err = k8s.watchPods(ctx, resourceVersion, changed, connected)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// watchPods follows the pod changes until the API server closes the watch.
+// It returns the last seen resource version to continue watching from.
+func (k8s *K8sAPI) watchPods(ctx context.Context, resourceVersion string, changed func(), connected func()) (string, error) {
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("resourceVersion", resourceVersion)
+	query.Set("allowWatchBookmarks", "true")
+	query.Set("timeoutSeconds", fmt.Sprint(int(watchTimeout.Seconds())))
+	resp, err := k8s.get(ctx, podsAPI, k8s.nodeSelector(query))
+	if err != nil {
+		return resourceVersion, err
+	}
+	defer resp.Body.Close()
+	connected()
+
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		event := watchEvent{}
+		if err := decoder.Decode(&event); err != nil {
+			if err == io.EOF {
+				return resourceVersion, nil
+			}
+			return resourceVersion, err
+		}
+		if event.Type == "ERROR" {
+			status := metav1.Status{}
+			if err := json.Unmarshal(event.Object, &status); err != nil {
+				return resourceVersion, err
+			}
+			// the resource version is too old (410 Gone) or any other error, both need a new list
+			return resourceVersion, fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+
+		pod := &corev1.Pod{}
+		if err := json.Unmarshal(event.Object, pod); err != nil {
+			return resourceVersion, err
+		}
+		resourceVersion = pod.ResourceVersion
+		k8s.podsMutex.Lock()
+		switch event.Type {
+		case "ADDED", "MODIFIED":
+			k8s.pods[pod.UID] = pod
+		case "DELETED":
+			delete(k8s.pods, pod.UID)
+		default:
+			// BOOKMARK only updates the resource version
+			k8s.podsMutex.Unlock()
+			continue
+		}
+		k8s.podsMutex.Unlock()
+		if err := k8s.updateFromPods(); err != nil {
+			return resourceVersion, err
+		}
+		changed()
+	}
+}
+
+// updateFromPods updates the DNS map from the currently known pods
+func (k8s *K8sAPI) updateFromPods() error {
+	k8s.podsMutex.Lock()
+	podlist := &corev1.PodList{Items: make([]corev1.Pod, 0, len(k8s.pods))}
+	for _, pod := range k8s.pods {
+		podlist.Items = append(podlist.Items, *pod)
+	}
+	k8s.podsMutex.Unlock()
+	return k8s.publish(podlist)
+}
+
+// publish updates the DNS map and the SRV and CNAME records from the pods
+func (k8s *K8sAPI) publish(podlist *corev1.PodList) error {
+	k8s.publishMutex.Lock()
+	defer k8s.publishMutex.Unlock()
+	k8s.current = podlist
+	return k8s.refresh(time.Now())
+}
+
+// refresh publishes the current pods together with the lingering pods. Published pods that got deleted
+// or started terminating linger until the grace period is over. publishMutex must be held.
+func (k8s *K8sAPI) refresh(now time.Time) error {
+	active := map[types.UID]*corev1.Pod{}
+	podlist := &corev1.PodList{}
+	for i := range k8s.current.Items {
+		pod := &k8s.current.Items[i]
+		if _, ok := k8s.localPod(pod); ok {
+			active[pod.UID] = pod
+		}
+		podlist.Items = append(podlist.Items, *pod)
+	}
+	if k8s.GracePeriod > 0 {
+		for uid, pod := range k8s.published {
+			if _, ok := active[uid]; ok {
+				continue
+			}
+			if _, ok := k8s.lingering[uid]; !ok {
+				k8s.lingering[uid] = lingeringPod{pod: pod, until: now.Add(k8s.GracePeriod)}
+			}
+		}
+	}
+	k8s.published = active
 
-	for k := range k8s.Feed.FeedDNSMap {
-		delete(k8s.Feed.FeedDNSMap, k)
+	var next time.Time
+	for uid, lingering := range k8s.lingering {
+		if _, ok := active[uid]; ok || !now.Before(lingering.until) {
+			delete(k8s.lingering, uid)
+			continue
+		}
+		podlist.Items = append(podlist.Items, *lingering.pod)
+		if next.IsZero() || lingering.until.Before(next) {
+			next = lingering.until
+		}
 	}
-	for host, ip := range podIPs {
-		k8s.Feed.FeedDNSMap[host] = ip
+	if k8s.expiry != nil {
+		k8s.expiry.Stop()
+	}
+	if !next.IsZero() {
+		k8s.expiry = time.AfterFunc(next.Sub(now), k8s.expire)
 	}
 
+	podIPs, err := k8s.getPodIPs(podlist)
+	if err != nil {
+		return err
+	}
+	k8s.Feed.setDNSMap(podIPs)
+	feedRecords := append(k8s.getPodServices(podlist), k8s.getPodCNAMEs(podlist)...)
+	k8s.Feed.setRecords(append(feedRecords, k8s.getPodPTRs(podlist)...))
 	return nil
 }
 
-// GetDNSMap returns the feeds DNS map
-func (k8s *K8sAPI) GetDNSMap() map[string]string {
-	return k8s.Feed.FeedDNSMap
+// expire removes the lingering pods whose grace period is over
+func (k8s *K8sAPI) expire() {
+	k8s.publishMutex.Lock()
+	err := k8s.refresh(time.Now())
+	changed := k8s.changed
+	k8s.publishMutex.Unlock()
+	if err != nil {
+		k8s.logger().Errorf("failed to remove expired pods, err: %v", err)
+		return
+	}
+	if changed != nil {
+		changed()
+	}
 }
 
 // getPodIPs extracts the IPs from the pods
-func (k8s *K8sAPI) getPodIPs(podlist *corev1.PodList) (map[string]string, error) {
-	podIPs := map[string]string{}
+func (k8s *K8sAPI) getPodIPs(podlist *corev1.PodList) (map[string][]string, error) {
+	podIPs := map[string][]string{}
 	for _, pod := range podlist.Items {
-		if podName, ok := pod.Labels["node-dns.host"]; ok {
-			for _, container := range pod.Spec.Containers {
-				podIPs[fmt.Sprintf("%s.%s", container.Name, podName)] = pod.Status.PodIP
+		if k8s.Compat {
+			for name, ips := range k8s.compatNames(&pod) {
+				podIPs[name] = ips
+			}
+		}
+		podName, ips, ok := k8s.publishedPod(&pod)
+		if !ok {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if !k8s.containerReady(&pod, container.Name) {
+				continue
+			}
+			for _, name := range k8s.containerNames(&pod, podName, container.Name) {
+				podIPs[name] = ips
 			}
 		}
+		if !k8s.podReady(&pod) {
+			continue
+		}
+		for _, alias := range splitList(pod.Annotations[aliasesAnnotation]) {
+			podIPs[alias] = ips
+		}
 	}
 	return podIPs, nil
 }
 
-// getPods gets all pods from the k8s api
-func (k8s *K8sAPI) getPods() (*corev1.PodList, error) {
+// getPodPTRs creates the PTR records of the pod addresses pointing to the primary name of the pod,
+// which is the first name of its first ready container. Aliases and other names are not used.
+func (k8s *K8sAPI) getPodPTRs(podlist *corev1.PodList) []records.Record {
+	ptrs := []records.Record{}
+	for _, pod := range podlist.Items {
+		podName, ips, ok := k8s.publishedPod(&pod)
+		if !ok {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if !k8s.containerReady(&pod, container.Name) {
+				continue
+			}
+			names := k8s.containerNames(&pod, podName, container.Name)
+			if len(names) == 0 {
+				continue
+			}
+			for _, ip := range ips {
+				reverse, err := mdns.ReverseAddr(ip)
+				if err != nil {
+					continue
+				}
+				ptrs = append(ptrs, records.Record{Name: reverse, Type: mdns.TypePTR, Target: names[0]})
+			}
+			break
+		}
+	}
+	return ptrs
+}
 
-	// Create a new request using http
-	req, err := http.NewRequest("GET", fmt.Sprintf("%s%s", k8s.URI, podsAPI), nil)
-	if err != nil {
-		return nil, err
+// getPodCNAMEs creates the CNAME records of the pods annotations
+func (k8s *K8sAPI) getPodCNAMEs(podlist *corev1.PodList) []records.Record {
+	cnames := []records.Record{}
+	for _, pod := range podlist.Items {
+		if _, _, ok := k8s.publishedPod(&pod); !ok || !k8s.podReady(&pod) {
+			continue
+		}
+		for _, pair := range splitList(pod.Annotations[cnameAnnotation]) {
+			name, target, ok := strings.Cut(pair, "=")
+			name, target = strings.TrimSpace(name), strings.TrimSpace(target)
+			if !ok || name == "" || target == "" {
+				k8s.logger().Warningf("ignoring invalid CNAME %q of pod %s/%s", pair, pod.Namespace, pod.Name)
+				continue
+			}
+			cnames = append(cnames, records.Record{Name: name, Type: mdns.TypeCNAME, Target: target})
+		}
 	}
+	return cnames
+}
 
-	if len(k8s.Token) > 0 {
-		// Create a Bearer string by appending string access token
-		var bearer = "Bearer " + k8s.Token
-		// add authorization header to the req
-		req.Header.Add("Authorization", bearer)
+// getPodServices creates an SRV record _<port>._<protocol>.<name> for each named container port and each
+// name of the container. Containers that opted in to DNS-SD are published as service instances as well,
+// using the first name of the container as instance name.
+func (k8s *K8sAPI) getPodServices(podlist *corev1.PodList) []records.Record {
+	services := []records.Record{}
+	for _, pod := range podlist.Items {
+		podName, _, ok := k8s.publishedPod(&pod)
+		if !ok {
+			continue
+		}
+		for _, container := range pod.Spec.Containers {
+			if !k8s.containerReady(&pod, container.Name) {
+				continue
+			}
+			names := k8s.containerNames(&pod, podName, container.Name)
+			if len(names) == 0 {
+				continue
+			}
+			dnssd := dnssdEnabled(&pod, container.Name)
+			for _, port := range container.Ports {
+				if port.Name == "" || port.ContainerPort <= 0 {
+					continue
+				}
+				protocol := port.Protocol
+				if protocol == "" {
+					protocol = corev1.ProtocolTCP
+				}
+				for _, target := range names {
+					services = append(services, records.Record{
+						Name:   fmt.Sprintf("_%s._%s.%s", port.Name, strings.ToLower(string(protocol)), target),
+						Type:   mdns.TypeSRV,
+						Target: target,
+						Port:   uint16(port.ContainerPort),
+						Weight: 100,
+					})
+				}
+				if dnssd {
+					instance := serviceInstance{
+						Instance: names[0],
+						Service:  port.Name,
+						Protocol: dnssdProtocol(string(protocol)),
+						Target:   names[0],
+						Port:     uint16(port.ContainerPort),
+						Text:     splitList(pod.Annotations[txtAnnotation]),
+					}
+					services = append(services, instance.records()...)
+				}
+			}
+		}
 	}
+	return services
+}
 
-	// Send req using http Client
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{InsecureSkipVerify: k8s.InsecureTLS},
+// dnssdEnabled checks whether the container opted in to DNS-SD using the annotation or label
+func dnssdEnabled(pod *corev1.Pod, container string) bool {
+	value, ok := pod.Annotations[dnssdKey]
+	if !ok {
+		value, ok = pod.Labels[dnssdKey]
+	}
+	if !ok {
+		return false
 	}
+	if value == "true" {
+		return true
+	}
+	return contains(splitList(value), container)
+}
 
-	client := &http.Client{Transport: tr}
-	resp, err := client.Do(req)
+// compatNames returns the names of the Kubernetes DNS specification of a pod on this node:
+// <a-b-c-d>.<namespace>.pod.<clusterDomain> for each address and, if the pod has a hostname
+// and subdomain, <hostname>.<subdomain>.<namespace>.svc.<clusterDomain>
+func (k8s *K8sAPI) compatNames(pod *corev1.Pod) map[string][]string {
+	names := map[string][]string{}
+	ips, ok := k8s.localPod(pod)
+	if !ok || !k8s.podReady(pod) {
+		return names
+	}
+	namespace := pod.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+	for _, ip := range ips {
+		dashed := strings.NewReplacer(".", "-", ":", "-").Replace(ip)
+		names[fmt.Sprintf("%s.%s.pod.%s", dashed, namespace, k8s.ClusterDomain)] = []string{ip}
+	}
+	if pod.Spec.Hostname != "" && pod.Spec.Subdomain != "" {
+		names[fmt.Sprintf("%s.%s.%s.svc.%s", pod.Spec.Hostname, pod.Spec.Subdomain, namespace, k8s.ClusterDomain)] = ips
+	}
+	return names
+}
+
+// localPod returns the addresses of a pod running on this node. Terminating pods are skipped,
+// as well as pods that are not running if only ready pods are published.
+func (k8s *K8sAPI) localPod(pod *corev1.Pod) ([]string, bool) {
+	// KubeEdge's metaserver ignores field selectors, so the node is checked here as well
+	if k8s.NodeName != "" && pod.Spec.NodeName != k8s.NodeName {
+		return nil, false
+	}
+	if pod.DeletionTimestamp != nil {
+		return nil, false
+	}
+	if k8s.ReadyOnly && pod.Status.Phase != corev1.PodRunning {
+		return nil, false
+	}
+	ips := getPodAddresses(pod)
+	return ips, len(ips) > 0
+}
+
+// podReady checks the pods Ready condition if only ready pods are published
+func (k8s *K8sAPI) podReady(pod *corev1.Pod) bool {
+	if !k8s.ReadyOnly {
+		return true
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// containerReady checks the readiness of a container if only ready containers are published.
+// Containers without status use the pods Ready condition.
+func (k8s *K8sAPI) containerReady(pod *corev1.Pod, container string) bool {
+	if !k8s.ReadyOnly {
+		return true
+	}
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.Name == container {
+			return status.Ready
+		}
+	}
+	return k8s.podReady(pod)
+}
+
+// publishedPod returns the pod name and addresses of a pod that is published on this node
+func (k8s *K8sAPI) publishedPod(pod *corev1.Pod) (string, []string, bool) {
+	ips, ok := k8s.localPod(pod)
+	if !ok {
+		return "", nil, false
+	}
+	podName, ok := pod.Labels[k8s.LabelKey]
+	if !ok {
+		podName, ok = pod.Annotations[k8s.LabelKey]
+	}
+	if !ok {
+		return "", nil, false
+	}
+	return podName, ips, true
+}
+
+// containerNames executes the name templates for a container. Templates that fail are skipped.
+func (k8s *K8sAPI) containerNames(pod *corev1.Pod, podName string, container string) []string {
+	data := nameData{
+		Container:   container,
+		Pod:         podName,
+		PodName:     pod.Name,
+		Namespace:   pod.Namespace,
+		Hostname:    pod.Spec.Hostname,
+		Labels:      pod.Labels,
+		Annotations: pod.Annotations,
+	}
+	if data.Hostname == "" {
+		data.Hostname = pod.Name
+	}
+	names := []string{}
+	for _, tmpl := range k8s.NameTemplates {
+		name := strings.Builder{}
+		if err := tmpl.Execute(&name, data); err != nil {
+			k8s.logger().Warningf("failed to create name of container %s in pod %s/%s: %v", container, pod.Namespace, pod.Name, err)
+			continue
+		}
+		if name.Len() > 0 && !contains(names, name.String()) {
+			names = append(names, name.String())
+		}
+	}
+	return names
+}
+
+// getPodAddresses returns all addresses of a pod. Dual-stack pods report one
+// address per IP family in PodIPs, older API servers only fill PodIP.
+func getPodAddresses(pod *corev1.Pod) []string {
+	ips := []string{}
+	for _, podIP := range pod.Status.PodIPs {
+		if podIP.IP != "" {
+			ips = append(ips, podIP.IP)
+		}
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// getPods gets all pods from the k8s api
+func (k8s *K8sAPI) getPods(ctx context.Context) (*corev1.PodList, error) {
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	resp, err := k8s.get(ctx, podsAPI, k8s.nodeSelector(url.Values{}))
 	if err != nil {
 		return nil, err
 	}
@@ -133,3 +720,44 @@ func (k8s *K8sAPI) getPods() (*corev1.PodList, error) {
 	}
 	return podlist, nil
 }
+
+// nodeSelector adds a field selector for the pods of this node to the query
+func (k8s *K8sAPI) nodeSelector(query url.Values) url.Values {
+	if k8s.NodeName != "" {
+		query.Set("fieldSelector", "spec.nodeName="+k8s.NodeName)
+	}
+	return query
+}
+
+// get sends a GET request to the k8s api
+func (k8s *K8sAPI) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	return apiGet(ctx, k8s.client, k8s.URI, k8s.Token, path, query)
+}
+
+// apiGet sends a GET request to the k8s api at uri, authenticated with the token if set
+func apiGet(ctx context.Context, client *http.Client, uri string, token string, path string, query url.Values) (*http.Response, error) {
+	// Create a new request using http
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("%s%s", uri, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+
+	if len(token) > 0 {
+		// Create a Bearer string by appending string access token
+		var bearer = "Bearer " + token
+		// add authorization header to the req
+		req.Header.Add("Authorization", bearer)
+	}
+
+	// Send req using http Client
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("request %s failed: %s", path, resp.Status)
+	}
+	return resp, nil
+}
@@ -0,0 +1,354 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/edgefarm/node-dns/pkg/records"
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testNodeName = "edge-node"
+
+func newTestConfig() *config.FeedConfig {
+	cfg := config.NewFeedConfig()
+	cfg.K8sapi.NodeName = testNodeName
+	return cfg
+}
+
+func newTestK8sAPI(t *testing.T, cfg *config.FeedConfig) *K8sAPI {
+	k8s, err := NewK8sAPI(cfg)
+	assert.Nil(t, err)
+	return k8s
+}
+
+func newTestPod(name string, host string, podIPs ...string) corev1.Pod {
+	pod := corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{"node-dns.host": host},
+		},
+		Spec: corev1.PodSpec{
+			NodeName:   testNodeName,
+			Containers: []corev1.Container{{Name: "nginx"}, {Name: "sidecar"}},
+		},
+	}
+	for _, ip := range podIPs {
+		pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+	}
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+	if len(podIPs) > 0 {
+		pod.Status.PodIP = podIPs[0]
+	}
+	return pod
+}
+
+func TestGetPodIPsDualStack(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	podlist := &corev1.PodList{Items: []corev1.Pod{
+		newTestPod("dual", "dual", "172.17.0.2", "fd00::2"),
+		newTestPod("pending", "pending"),
+	}}
+
+	podIPs, err := k8s.getPodIPs(podlist)
+	assert.Nil(err)
+	assert.Equal([]string{"172.17.0.2", "fd00::2"}, podIPs["nginx.dual"])
+	assert.Equal([]string{"172.17.0.2", "fd00::2"}, podIPs["sidecar.dual"])
+	assert.NotContains(podIPs, "nginx.pending")
+}
+
+func TestGetPodIPsLegacyPodIP(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	pod := newTestPod("legacy", "legacy")
+	pod.Status.PodIP = "172.17.0.3"
+
+	podIPs, err := k8s.getPodIPs(&corev1.PodList{Items: []corev1.Pod{pod}})
+	assert.Nil(err)
+	assert.Equal([]string{"172.17.0.3"}, podIPs["nginx.legacy"])
+}
+
+func TestWatchPods(t *testing.T) {
+	assert := assert.New(t)
+	watches := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") != "true" {
+			assert.Equal("spec.nodeName="+testNodeName, r.URL.Query().Get("fieldSelector"))
+			podlist := corev1.PodList{Items: []corev1.Pod{newTestPod("first", "first", "172.17.0.2")}}
+			podlist.ResourceVersion = "1"
+			assert.Nil(json.NewEncoder(w).Encode(podlist))
+			return
+		}
+		assert.Equal("spec.nodeName="+testNodeName, r.URL.Query().Get("fieldSelector"))
+		watches <- r.URL.Query().Get("resourceVersion")
+		pod := newTestPod("second", "second", "172.17.0.3")
+		pod.UID = "second"
+		pod.ResourceVersion = "2"
+		object, _ := json.Marshal(pod)
+		fmt.Fprintf(w, `{"type":"ADDED","object":%s}`+"\n", object)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	cfg := newTestConfig()
+	cfg.K8sapi.URI = server.URL
+	k8s := newTestK8sAPI(t, cfg)
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go k8s.Watch(stop, func() { changed <- struct{}{} })
+
+	for _, expected := range []string{"nginx.first", "nginx.second"} {
+		select {
+		case <-changed:
+			assert.Contains(k8s.GetDNSMap(), expected)
+		case <-time.After(time.Second):
+			t.Fatalf("no update for %s", expected)
+		}
+	}
+	assert.Equal("1", <-watches)
+}
+
+func TestGetPodIPsOtherNode(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	local := newTestPod("local", "shared", "172.17.0.2")
+	remote := newTestPod("remote", "shared", "172.18.0.2")
+	remote.Spec.NodeName = "other-node"
+
+	podIPs, err := k8s.getPodIPs(&corev1.PodList{Items: []corev1.Pod{local, remote}})
+	assert.Nil(err)
+	assert.Equal([]string{"172.17.0.2"}, podIPs["nginx.shared"])
+}
+
+func TestGetPodServices(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	pod := newTestPod("web", "web", "172.17.0.2")
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{
+		{Name: "http", ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+		{Name: "metrics", ContainerPort: 9090},
+		{Name: "syslog", ContainerPort: 514, Protocol: corev1.ProtocolUDP},
+		{ContainerPort: 22},
+	}
+
+	services := k8s.getPodServices(&corev1.PodList{Items: []corev1.Pod{pod, newTestPod("pending", "pending")}})
+	assert.Equal([]records.Record{
+		{Name: "_http._tcp.nginx.web", Type: mdns.TypeSRV, Target: "nginx.web", Port: 8080, Weight: 100},
+		{Name: "_metrics._tcp.nginx.web", Type: mdns.TypeSRV, Target: "nginx.web", Port: 9090, Weight: 100},
+		{Name: "_syslog._udp.nginx.web", Type: mdns.TypeSRV, Target: "nginx.web", Port: 514, Weight: 100},
+	}, services)
+}
+
+func TestGetPodServicesDNSSD(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	pod := newTestPod("web", "web", "172.17.0.2")
+	pod.Annotations = map[string]string{dnssdKey: "nginx", txtAnnotation: "path=/, version=1"}
+	pod.Spec.Containers[0].Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}
+	pod.Spec.Containers[1].Ports = []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9090}}
+
+	services := k8s.getPodServices(&corev1.PodList{Items: []corev1.Pod{pod}})
+	assert.Contains(services, records.Record{Name: "_services._dns-sd._udp", Type: mdns.TypePTR, Target: "_http._tcp"})
+	assert.Contains(services, records.Record{Name: "_http._tcp", Type: mdns.TypePTR, Target: "nginx-web._http._tcp"})
+	assert.Contains(services, records.Record{Name: "nginx-web._http._tcp", Type: mdns.TypeSRV, Target: "nginx.web", Port: 8080, Weight: 100})
+	assert.Contains(services, records.Record{Name: "nginx-web._http._tcp", Type: mdns.TypeTXT, Text: []string{"path=/", "version=1"}})
+	assert.NotContains(services, records.Record{Name: "_services._dns-sd._udp", Type: mdns.TypePTR, Target: "_metrics._tcp"})
+}
+
+func TestGetPodAliases(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	pod := newTestPod("db", "db", "172.17.0.2")
+	pod.Annotations = map[string]string{
+		aliasesAnnotation: "db, db.local",
+		cnameAnnotation:   "api=backend.mypod,invalid, www = example.com",
+	}
+	podlist := &corev1.PodList{Items: []corev1.Pod{pod}}
+
+	podIPs, err := k8s.getPodIPs(podlist)
+	assert.Nil(err)
+	assert.Equal([]string{"172.17.0.2"}, podIPs["db"])
+	assert.Equal([]string{"172.17.0.2"}, podIPs["db.local"])
+	assert.Equal([]records.Record{
+		{Name: "api", Type: mdns.TypeCNAME, Target: "backend.mypod"},
+		{Name: "www", Type: mdns.TypeCNAME, Target: "example.com"},
+	}, k8s.getPodCNAMEs(podlist))
+}
+
+// buildRecords builds the records of the feed the way EdgeDNS does
+func buildRecords(t *testing.T, k8s *K8sAPI) *records.Snapshot {
+	builder := records.NewBuilder()
+	for name, ips := range k8s.GetDNSMap() {
+		for _, ip := range ips {
+			assert.Nil(t, builder.AddAddress(name, ip, "k8sapi"))
+		}
+	}
+	for _, record := range k8s.GetRecords() {
+		builder.Add(record)
+	}
+	return builder.Build()
+}
+
+func TestGetPodPTRs(t *testing.T) {
+	assert := assert.New(t)
+	cfg := newTestConfig()
+	cfg.K8sapi.Compat = true
+	k8s := newTestK8sAPI(t, cfg)
+	pod := newTestPod("web", "web", "172.17.0.2", "fd00::2")
+	pod.Namespace = "shop"
+	pod.Annotations = map[string]string{aliasesAnnotation: "db"}
+	assert.Nil(k8s.publish(&corev1.PodList{Items: []corev1.Pod{pod}}))
+
+	// one PTR record per address pointing to the first container, not to the sidecar, alias or compat name
+	snapshot := buildRecords(t, k8s)
+	for _, ip := range []string{"172.17.0.2", "fd00::2"} {
+		reverse, _ := mdns.ReverseAddr(ip)
+		ptr, ok := snapshot.LookupType(reverse, mdns.TypePTR)
+		assert.True(ok, ip)
+		assert.Len(ptr, 1, ip)
+		assert.Equal("nginx.web", ptr[0].Target, ip)
+	}
+
+	// the first ready container is used
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "nginx", Ready: false},
+		{Name: "sidecar", Ready: true},
+	}
+	assert.Nil(k8s.publish(&corev1.PodList{Items: []corev1.Pod{pod}}))
+	ptr, _ := buildRecords(t, k8s).LookupType("2.0.17.172.in-addr.arpa", mdns.TypePTR)
+	assert.Len(ptr, 1)
+	assert.Equal("sidecar.web", ptr[0].Target)
+}
+
+func TestNameTemplates(t *testing.T) {
+	assert := assert.New(t)
+	cfg := newTestConfig()
+	cfg.K8sapi.LabelKey = "example.com/dns"
+	cfg.K8sapi.NameTemplates = []string{"{{.Container}}.{{.Pod}}.{{.Namespace}}", "{{.Hostname}}.{{.Labels.app}}"}
+	k8s := newTestK8sAPI(t, cfg)
+	first := newTestPod("first", "", "172.17.0.2")
+	first.Namespace = "first"
+	first.Labels = map[string]string{"example.com/dns": "web", "app": "shop"}
+	second := newTestPod("second", "", "172.17.0.3")
+	second.Namespace = "second"
+	second.Annotations = map[string]string{"example.com/dns": "web"}
+
+	podIPs, err := k8s.getPodIPs(&corev1.PodList{Items: []corev1.Pod{first, second}})
+	assert.Nil(err)
+	assert.Equal(map[string][]string{
+		"nginx.web.first":    {"172.17.0.2"},
+		"sidecar.web.first":  {"172.17.0.2"},
+		"first.shop":         {"172.17.0.2"},
+		"nginx.web.second":   {"172.17.0.3"},
+		"sidecar.web.second": {"172.17.0.3"},
+	}, podIPs)
+
+	cfg.K8sapi.NameTemplates = []string{"{{.Container"}
+	_, err = NewK8sAPI(cfg)
+	assert.NotNil(err)
+}
+
+func TestCompatNames(t *testing.T) {
+	assert := assert.New(t)
+	cfg := newTestConfig()
+	cfg.K8sapi.Compat = true
+	k8s := newTestK8sAPI(t, cfg)
+	pod := newTestPod("unlabelled", "", "172.17.0.2", "fd00::2")
+	pod.Labels = nil
+	pod.Namespace = "shop"
+	pod.Spec.Hostname = "db-0"
+	pod.Spec.Subdomain = "db"
+	remote := newTestPod("remote", "", "172.18.0.2")
+	remote.Spec.NodeName = "other-node"
+
+	podIPs, err := k8s.getPodIPs(&corev1.PodList{Items: []corev1.Pod{pod, remote}})
+	assert.Nil(err)
+	assert.Equal(map[string][]string{
+		"172-17-0-2.shop.pod.cluster.local": {"172.17.0.2"},
+		"fd00--2.shop.pod.cluster.local":    {"fd00::2"},
+		"db-0.db.shop.svc.cluster.local":    {"172.17.0.2", "fd00::2"},
+	}, podIPs)
+}
+
+func TestGetPodIPsReadiness(t *testing.T) {
+	assert := assert.New(t)
+	k8s := newTestK8sAPI(t, newTestConfig())
+	partial := newTestPod("partial", "partial", "172.17.0.2")
+	partial.Status.ContainerStatuses = []corev1.ContainerStatus{
+		{Name: "nginx", Ready: true},
+		{Name: "sidecar", Ready: false},
+	}
+	unready := newTestPod("unready", "unready", "172.17.0.3")
+	unready.Status.Conditions[0].Status = corev1.ConditionFalse
+	pending := newTestPod("pending", "pending", "172.17.0.4")
+	pending.Status.Phase = corev1.PodPending
+	terminating := newTestPod("terminating", "terminating", "172.17.0.5")
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	podlist := &corev1.PodList{Items: []corev1.Pod{partial, unready, pending, terminating}}
+
+	podIPs, err := k8s.getPodIPs(podlist)
+	assert.Nil(err)
+	assert.Equal(map[string][]string{"nginx.partial": {"172.17.0.2"}}, podIPs)
+
+	k8s.ReadyOnly = false
+	podIPs, err = k8s.getPodIPs(podlist)
+	assert.Nil(err)
+	assert.Len(podIPs, 6)
+	assert.NotContains(podIPs, "nginx.terminating")
+}
+
+func TestGracePeriod(t *testing.T) {
+	assert := assert.New(t)
+	cfg := newTestConfig()
+	cfg.K8sapi.GracePeriod = 100 * time.Millisecond
+	k8s := newTestK8sAPI(t, cfg)
+	changed := make(chan struct{}, 1)
+	k8s.changed = func() { changed <- struct{}{} }
+	pod := newTestPod("web", "web", "172.17.0.2")
+	pod.UID = "web"
+
+	assert.Nil(k8s.publish(&corev1.PodList{Items: []corev1.Pod{pod}}))
+	assert.Contains(k8s.GetDNSMap(), "nginx.web")
+
+	terminating := pod
+	terminating.DeletionTimestamp = &metav1.Time{Time: time.Now()}
+	assert.Nil(k8s.publish(&corev1.PodList{Items: []corev1.Pod{terminating}}))
+	assert.Contains(k8s.GetDNSMap(), "nginx.web")
+	assert.Nil(k8s.publish(&corev1.PodList{}))
+	assert.Contains(k8s.GetDNSMap(), "nginx.web")
+
+	select {
+	case <-changed:
+		assert.NotContains(k8s.GetDNSMap(), "nginx.web")
+	case <-time.After(time.Second):
+		t.Fatal("records of the deleted pod have not expired")
+	}
+}
@@ -0,0 +1,64 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"fmt"
+
+	"k8s.io/klog"
+)
+
+// Logger receives the log output of the registry and its feeds.
+// Loggers that implement Debugf(format string, args ...interface{}) receive the verbose messages as well.
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Warningf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// debugLogger is implemented by loggers that want the verbose messages
+type debugLogger interface {
+	Debugf(format string, args ...interface{})
+}
+
+// klogLogger writes to klog, it is used until another logger is set
+type klogLogger struct{}
+
+func (klogLogger) Infof(format string, args ...interface{}) {
+	klog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Warningf(format string, args ...interface{}) {
+	klog.WarningDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Errorf(format string, args ...interface{}) {
+	klog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (klogLogger) Debugf(format string, args ...interface{}) {
+	if klog.V(2) {
+		klog.InfoDepth(1, fmt.Sprintf(format, args...))
+	}
+}
+
+// debugf passes a verbose message to the logger if it wants them
+func debugf(log Logger, format string, args ...interface{}) {
+	if d, ok := log.(debugLogger); ok {
+		d.Debugf(format, args...)
+	}
+}
@@ -0,0 +1,307 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/edgefarm/node-dns/pkg/records"
+)
+
+// Entry is an address of a name together with the feed it came from
+type Entry struct {
+	Address string
+	Source  string
+}
+
+// Registry merges the DNS maps of several feeds
+type Registry struct {
+	policy string
+	feeds  []registered
+	// firstSeen orders the names of each feed by the time the feed published them for the first-wins policy
+	firstSeen map[string]map[string]uint64
+	sequence  uint64
+	log       Logger
+	mutex     sync.Mutex
+}
+
+// registered is a feed within the registry
+type registered struct {
+	name     string
+	priority int
+	feed     If
+}
+
+// NewRegistry creates an empty registry that resolves conflicting names using the policy
+func NewRegistry(policy string) (*Registry, error) {
+	switch policy {
+	case config.ConflictFirstWins, config.ConflictHighestPriorityWins, config.ConflictAllAddresses:
+	default:
+		return nil, fmt.Errorf("unknown conflict policy %q", policy)
+	}
+	return &Registry{
+		policy:    policy,
+		firstSeen: map[string]map[string]uint64{},
+		log:       klogLogger{},
+	}, nil
+}
+
+// NewRegistryFromConfig creates a registry containing all enabled feeds
+func NewRegistryFromConfig(config *config.FeedConfig) (*Registry, error) {
+	r, err := NewRegistry(config.ConflictPolicy)
+	if err != nil {
+		return nil, err
+	}
+	if config.K8sapi.Enabled {
+		k8s, err := NewK8sAPI(config)
+		if err != nil {
+			return nil, err
+		}
+		r.Register("k8sapi", config.K8sapi.Priority, k8s)
+	}
+	if config.Services.Enabled {
+		r.Register("services", config.Services.Priority, NewServices(config))
+	}
+	if config.Docker.Enabled {
+		r.Register("docker", config.Docker.Priority, NewDocker(config))
+	}
+	if config.CRI.Enabled {
+		cri, err := NewCRI(config)
+		if err != nil {
+			return nil, err
+		}
+		r.Register("cri", config.CRI.Priority, cri)
+	}
+	if config.Static.Enabled {
+		r.Register("static", config.Static.Priority, NewStatic(config))
+	}
+	return r, nil
+}
+
+// Register adds a feed. Feeds with a higher priority win conflicts, feeds of the same
+// priority are ordered by registration.
+func (r *Registry) Register(name string, priority int, f If) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	setLogger(f, r.log)
+	r.feeds = append(r.feeds, registered{name: name, priority: priority, feed: f})
+	sort.SliceStable(r.feeds, func(i, j int) bool {
+		return r.feeds[i].priority > r.feeds[j].priority
+	})
+}
+
+// SetLogger sets the logger of the registry and of the registered feeds, including the ones
+// registered later. It must be called before the feeds are used.
+func (r *Registry) SetLogger(log Logger) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.log = log
+	for _, f := range r.feeds {
+		setLogger(f.feed, log)
+	}
+}
+
+// Update triggers an update of all feeds
+func (r *Registry) Update(ctx context.Context) error {
+	var lastErr error
+	for _, f := range r.registeredFeeds() {
+		if err := f.feed.Update(ctx); err != nil {
+			r.logger().Errorf("failed to update feed %s, err: %v", f.name, err)
+			lastErr = err
+			continue
+		}
+		r.changed(f)
+	}
+	return lastErr
+}
+
+// Watch keeps all feeds up to date until stop is closed. Feeds that can't watch are polled.
+func (r *Registry) Watch(stop <-chan struct{}, changed func()) {
+	feeds := r.registeredFeeds()
+	if len(feeds) == 0 {
+		r.logger().Warningf("no feed enabled, only forwarding queries")
+	}
+	wg := sync.WaitGroup{}
+	for _, f := range feeds {
+		r.logger().Infof("starting feed %s", f.name)
+		wg.Add(1)
+		go func(f registered) {
+			defer wg.Done()
+			notify := func() {
+				r.changed(f)
+				changed()
+			}
+			if watcher, ok := f.feed.(Watcher); ok {
+				watcher.Watch(stop, notify)
+			} else {
+				Poll(f.feed, pollInterval, stop, notify, r.logger())
+			}
+		}(f)
+	}
+	wg.Wait()
+}
+
+// GetDNSMap returns the merged DNS map of all feeds
+func (r *Registry) GetDNSMap() map[string][]string {
+	dnsMap := map[string][]string{}
+	for name, entries := range r.Entries() {
+		for _, entry := range entries {
+			dnsMap[name] = append(dnsMap[name], entry.Address)
+		}
+	}
+	return dnsMap
+}
+
+// Entries returns the merged addresses of all feeds together with the feed each address came from
+func (r *Registry) Entries() map[string][]Entry {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// collect the publishers of each name ordered by priority
+	publishers := map[string][]string{}
+	published := map[string]map[string][]string{}
+	for _, f := range r.feeds {
+		dnsMap := f.feed.GetDNSMap()
+		published[f.name] = dnsMap
+		if r.policy == config.ConflictFirstWins {
+			r.observe(f.name, dnsMap)
+		}
+		for name := range dnsMap {
+			publishers[name] = append(publishers[name], f.name)
+		}
+	}
+
+	entries := map[string][]Entry{}
+	for name, sources := range publishers {
+		if r.policy == config.ConflictAllAddresses {
+			seen := map[string]bool{}
+			for _, source := range sources {
+				for _, address := range published[source][name] {
+					if !seen[address] {
+						seen[address] = true
+						entries[name] = append(entries[name], Entry{Address: address, Source: source})
+					}
+				}
+			}
+			continue
+		}
+
+		owner := sources[0]
+		if r.policy == config.ConflictFirstWins {
+			for _, source := range sources[1:] {
+				if r.firstSeen[source][name] < r.firstSeen[owner][name] {
+					owner = source
+				}
+			}
+		}
+		if len(sources) > 1 {
+			debugf(r.log, "name %s is published by %v, using %s", name, sources, owner)
+		}
+		for _, address := range published[owner][name] {
+			entries[name] = append(entries[name], Entry{Address: address, Source: owner})
+		}
+	}
+	return entries
+}
+
+// changed records when the names of the feed were published, as soon as the feed reports a change
+func (r *Registry) changed(f registered) {
+	if r.policy != config.ConflictFirstWins {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.observe(f.name, f.feed.GetDNSMap())
+}
+
+// observe numbers the names the feed publishes for the first time and forgets the ones it dropped.
+// Names that several feeds published since the last observation are ordered by priority.
+func (r *Registry) observe(feed string, dnsMap map[string][]string) {
+	seen, ok := r.firstSeen[feed]
+	if !ok {
+		seen = map[string]uint64{}
+		r.firstSeen[feed] = seen
+	}
+	for name := range seen {
+		if _, ok := dnsMap[name]; !ok {
+			delete(seen, name)
+		}
+	}
+	for name := range dnsMap {
+		if _, ok := seen[name]; !ok {
+			r.sequence++
+			seen[name] = r.sequence
+		}
+	}
+}
+
+// Records returns the records besides addresses of all feeds. They are not subject to the
+// conflict policy, the records of all feeds are returned with the feed as source.
+func (r *Registry) Records() []records.Record {
+	all := []records.Record{}
+	for _, f := range r.registeredFeeds() {
+		recordFeed, ok := f.feed.(RecordFeed)
+		if !ok {
+			continue
+		}
+		for _, record := range recordFeed.GetRecords() {
+			record.Source = f.name
+			all = append(all, record)
+		}
+	}
+	return all
+}
+
+// Close closes all feeds that hold resources, e.g. connections. The feeds must not be used afterwards.
+func (r *Registry) Close() error {
+	var lastErr error
+	for _, f := range r.registeredFeeds() {
+		if closer, ok := f.feed.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				r.logger().Errorf("failed to close feed %s, err: %v", f.name, err)
+				lastErr = err
+			}
+		}
+	}
+	return lastErr
+}
+
+// logger returns the logger of the registry
+func (r *Registry) logger() Logger {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.log
+}
+
+// setLogger sets the logger of the feed if it has one
+func setLogger(f If, log Logger) {
+	if l, ok := f.(interface{ SetLogger(Logger) }); ok {
+		l.SetLogger(log)
+	}
+}
+
+// registeredFeeds returns a copy of the registered feeds
+func (r *Registry) registeredFeeds() []registered {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]registered{}, r.feeds...)
+}
@@ -0,0 +1,162 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// testFeed is a feed with a fixed DNS map
+type testFeed struct {
+	dnsMap map[string][]string
+}
+
+func (f *testFeed) Update(ctx context.Context) error {
+	return nil
+}
+
+func (f *testFeed) GetDNSMap() map[string][]string {
+	return f.dnsMap
+}
+
+func newTestRegistry(t *testing.T, policy string) (*Registry, *testFeed, *testFeed) {
+	r, err := NewRegistry(policy)
+	assert.Nil(t, err)
+	low := &testFeed{dnsMap: map[string][]string{
+		"shared": {"10.0.0.1"},
+		"low":    {"10.0.0.2"},
+	}}
+	high := &testFeed{dnsMap: map[string][]string{
+		"shared": {"10.0.1.1", "10.0.0.1"},
+	}}
+	r.Register("low", 10, low)
+	return r, low, high
+}
+
+func TestRegistryHighestPriorityWins(t *testing.T) {
+	assert := assert.New(t)
+	r, _, high := newTestRegistry(t, config.ConflictHighestPriorityWins)
+	assert.Equal([]string{"10.0.0.1"}, r.GetDNSMap()["shared"])
+
+	r.Register("high", 20, high)
+	entries := r.Entries()
+	assert.Equal([]Entry{{Address: "10.0.1.1", Source: "high"}, {Address: "10.0.0.1", Source: "high"}}, entries["shared"])
+	assert.Equal([]Entry{{Address: "10.0.0.2", Source: "low"}}, entries["low"])
+}
+
+func TestRegistryFirstWins(t *testing.T) {
+	assert := assert.New(t)
+	r, low, high := newTestRegistry(t, config.ConflictFirstWins)
+	assert.Equal([]string{"10.0.0.1"}, r.GetDNSMap()["shared"])
+
+	// the name stays with the feed that published it first
+	r.Register("high", 20, high)
+	assert.Equal([]string{"10.0.0.1"}, r.GetDNSMap()["shared"])
+
+	// and moves on once the first feed drops it
+	low.dnsMap = map[string][]string{}
+	assert.Equal([]string{"10.0.1.1", "10.0.0.1"}, r.GetDNSMap()["shared"])
+	low.dnsMap = map[string][]string{"shared": {"10.0.0.1"}}
+	assert.Equal([]string{"10.0.1.1", "10.0.0.1"}, r.GetDNSMap()["shared"])
+}
+
+// publishingFeed is a watched feed that publishes the DNS maps passed to it
+type publishingFeed struct {
+	maps   chan map[string][]string
+	dnsMap map[string][]string
+	mutex  sync.Mutex
+}
+
+func (f *publishingFeed) Update(ctx context.Context) error {
+	return nil
+}
+
+func (f *publishingFeed) GetDNSMap() map[string][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.dnsMap
+}
+
+func (f *publishingFeed) Watch(stop <-chan struct{}, changed func()) {
+	for {
+		select {
+		case dnsMap := <-f.maps:
+			f.mutex.Lock()
+			f.dnsMap = dnsMap
+			f.mutex.Unlock()
+			changed()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func TestRegistryFirstWinsLowerPriorityFirst(t *testing.T) {
+	assert := assert.New(t)
+	r, err := NewRegistry(config.ConflictFirstWins)
+	assert.Nil(err)
+	low := &publishingFeed{maps: make(chan map[string][]string)}
+	high := &publishingFeed{maps: make(chan map[string][]string)}
+	r.Register("low", 10, low)
+	r.Register("high", 20, high)
+
+	notified := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go r.Watch(stop, func() { notified <- struct{}{} })
+
+	// both feeds publish the name before the maps are merged, like coalesced notifications
+	for _, publish := range []struct {
+		feed    *publishingFeed
+		address string
+	}{{low, "10.0.0.1"}, {high, "10.0.1.1"}} {
+		publish.feed.maps <- map[string][]string{"shared": {publish.address}}
+		select {
+		case <-notified:
+		case <-time.After(time.Second):
+			t.Fatal("change not notified")
+		}
+	}
+	assert.Equal([]Entry{{Address: "10.0.0.1", Source: "low"}}, r.Entries()["shared"])
+}
+
+func TestRegistryAllAddresses(t *testing.T) {
+	assert := assert.New(t)
+	r, _, high := newTestRegistry(t, config.ConflictAllAddresses)
+	r.Register("high", 20, high)
+	assert.Equal([]Entry{
+		{Address: "10.0.1.1", Source: "high"},
+		{Address: "10.0.0.1", Source: "high"},
+	}, r.Entries()["shared"])
+
+	high.dnsMap = map[string][]string{"shared": {"10.0.1.1"}}
+	assert.Equal([]Entry{
+		{Address: "10.0.1.1", Source: "high"},
+		{Address: "10.0.0.1", Source: "low"},
+	}, r.Entries()["shared"])
+}
+
+func TestRegistryUnknownPolicy(t *testing.T) {
+	_, err := NewRegistry("last-wins")
+	assert.NotNil(t, err)
+}
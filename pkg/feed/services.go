@@ -0,0 +1,161 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+)
+
+const (
+	servicesAPI       = "/api/v1/services"
+	endpointSlicesAPI = "/apis/discovery.k8s.io/v1/endpointslices"
+)
+
+// Services defines the k8s services feed. Services are resolved to their ready endpoints
+// on this node, like a service with internalTrafficPolicy=Local.
+type Services struct {
+	Feed
+	URI         string
+	Token       string
+	InsecureTLS bool
+	// NodeName restricts the endpoints to the ones on this node
+	NodeName      string
+	ClusterDomain string
+	// ClusterIPFallback resolves services without local endpoints to their cluster IPs
+	ClusterIPFallback bool
+
+	client *http.Client
+}
+
+// NewServices creates a new feed resolving k8s services
+func NewServices(config *config.FeedConfig) *Services {
+	s := &Services{
+		URI:               config.K8sapi.URI,
+		Token:             config.K8sapi.Token,
+		InsecureTLS:       config.K8sapi.InsecureTLS,
+		NodeName:          getNodeName(config.K8sapi.NodeName),
+		ClusterDomain:     strings.Trim(config.ClusterDomain, "."),
+		ClusterIPFallback: config.Services.ClusterIPFallback,
+		Feed: Feed{
+			FeedDNSMap: make(map[string][]string),
+		},
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: config.K8sapi.InsecureTLS},
+			},
+			Timeout: requestTimeout,
+		},
+	}
+	return s
+}
+
+// Update triggers an update of the DNS cache
+func (s *Services) Update(ctx context.Context) error {
+	debugf(s.logger(), "k8s services feed uses endpoints of %s", nodeDescription(s.NodeName))
+	ctx, cancel := context.WithTimeout(ctx, requestTimeout)
+	defer cancel()
+	slices := &discoveryv1.EndpointSliceList{}
+	if err := s.list(ctx, endpointSlicesAPI, slices); err != nil {
+		return err
+	}
+	services := &corev1.ServiceList{}
+	if s.ClusterIPFallback {
+		if err := s.list(ctx, servicesAPI, services); err != nil {
+			return err
+		}
+	}
+	s.Feed.setDNSMap(s.getServiceIPs(slices, services))
+	return nil
+}
+
+// GetDNSMap returns the feeds DNS map
+func (s *Services) GetDNSMap() map[string][]string {
+	return s.Feed.dnsMap()
+}
+
+// getServiceIPs maps the name <service>.<namespace>.svc.<clusterDomain> of each service to the
+// addresses of its ready endpoints on this node, or to its cluster IPs if there are none
+func (s *Services) getServiceIPs(slices *discoveryv1.EndpointSliceList, services *corev1.ServiceList) map[string][]string {
+	serviceIPs := map[string][]string{}
+	for _, slice := range slices.Items {
+		service, ok := slice.Labels[discoveryv1.LabelServiceName]
+		if !ok {
+			continue
+		}
+		name := s.serviceName(service, slice.Namespace)
+		for _, endpoint := range slice.Endpoints {
+			if !s.localEndpoint(endpoint) {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				if !contains(serviceIPs[name], address) {
+					serviceIPs[name] = append(serviceIPs[name], address)
+				}
+			}
+		}
+	}
+	for _, service := range services.Items {
+		name := s.serviceName(service.Name, service.Namespace)
+		if _, ok := serviceIPs[name]; ok {
+			continue
+		}
+		clusterIPs := []string{}
+		for _, ip := range append([]string{service.Spec.ClusterIP}, service.Spec.ClusterIPs...) {
+			if ip != "" && ip != corev1.ClusterIPNone && !contains(clusterIPs, ip) {
+				clusterIPs = append(clusterIPs, ip)
+			}
+		}
+		if len(clusterIPs) > 0 {
+			serviceIPs[name] = clusterIPs
+		}
+	}
+	return serviceIPs
+}
+
+// localEndpoint checks whether an endpoint is ready and on this node. Endpoints with an
+// unknown readiness are treated as ready, as defined by the EndpointSlice API.
+func (s *Services) localEndpoint(endpoint discoveryv1.Endpoint) bool {
+	if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+		return false
+	}
+	return s.NodeName == "" || (endpoint.NodeName != nil && *endpoint.NodeName == s.NodeName)
+}
+
+// serviceName returns the fully qualified name of a service without trailing dot
+func (s *Services) serviceName(service string, namespace string) string {
+	return fmt.Sprintf("%s.%s.svc.%s", service, namespace, s.ClusterDomain)
+}
+
+// list gets a list of objects from the k8s api
+func (s *Services) list(ctx context.Context, path string, list interface{}) error {
+	resp, err := apiGet(ctx, s.client, s.URI, s.Token, path, url.Values{})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(list)
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func newTestEndpointSlice(service string, endpoints ...discoveryv1.Endpoint) discoveryv1.EndpointSlice {
+	return discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      service + "-abcde",
+			Namespace: "shop",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: service},
+		},
+		Endpoints: endpoints,
+	}
+}
+
+func newTestEndpoint(address string, node string, ready bool) discoveryv1.Endpoint {
+	return discoveryv1.Endpoint{
+		Addresses:  []string{address},
+		NodeName:   &node,
+		Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+	}
+}
+
+func newTestService(name string, clusterIP string) corev1.Service {
+	return corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "shop"},
+		Spec:       corev1.ServiceSpec{ClusterIP: clusterIP, ClusterIPs: []string{clusterIP}},
+	}
+}
+
+func TestServicesUpdate(t *testing.T) {
+	assert := assert.New(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case endpointSlicesAPI:
+			assert.Nil(json.NewEncoder(w).Encode(discoveryv1.EndpointSliceList{Items: []discoveryv1.EndpointSlice{
+				newTestEndpointSlice("web",
+					newTestEndpoint("172.17.0.2", testNodeName, true),
+					newTestEndpoint("172.17.0.3", testNodeName, false),
+					newTestEndpoint("172.18.0.2", "other-node", true),
+				),
+				newTestEndpointSlice("db", newTestEndpoint("172.18.0.3", "other-node", true)),
+			}}))
+		case servicesAPI:
+			assert.Nil(json.NewEncoder(w).Encode(corev1.ServiceList{Items: []corev1.Service{
+				newTestService("web", "10.96.0.10"),
+				newTestService("db", "10.96.0.11"),
+				newTestService("headless", corev1.ClusterIPNone),
+			}}))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	cfg := newTestConfig()
+	cfg.K8sapi.URI = server.URL
+	services := NewServices(cfg)
+	assert.Nil(services.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"web.shop.svc.cluster.local": {"172.17.0.2"},
+	}, services.GetDNSMap())
+
+	services.ClusterIPFallback = true
+	assert.Nil(services.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"web.shop.svc.cluster.local": {"172.17.0.2"},
+		"db.shop.svc.cluster.local":  {"10.96.0.11"},
+	}, services.GetDNSMap())
+}
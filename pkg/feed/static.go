@@ -0,0 +1,203 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// Static defines the feed of static records from the configuration and from files
+type Static struct {
+	Feed
+	Records []config.StaticRecord
+	Files   []string
+
+	// fileRecords are the records of each file when it was last read successfully
+	fileRecords map[string][]config.StaticRecord
+	filesMutex  sync.Mutex
+}
+
+// NewStatic creates a new feed of static records
+func NewStatic(config *config.FeedConfig) *Static {
+	return &Static{
+		Records: config.Static.Records,
+		Files:   config.Static.Files,
+		Feed: Feed{
+			FeedDNSMap: make(map[string][]string),
+		},
+	}
+}
+
+// Update reads the records from the configuration and all files again. A file that can't be read
+// is logged and its records of the last successful read are kept, the other records are published anyway.
+func (s *Static) Update(ctx context.Context) error {
+	s.logger().Infof("Updating DNS cache")
+	dnsMap := map[string][]string{}
+	s.addRecords(dnsMap, s.Records)
+	for _, file := range s.Files {
+		s.addRecords(dnsMap, s.readFile(file))
+	}
+	s.Feed.setDNSMap(dnsMap)
+	return nil
+}
+
+// readFile returns the records of the file, or its records of the last successful read if it can't be read
+func (s *Static) readFile(file string) []config.StaticRecord {
+	s.filesMutex.Lock()
+	defer s.filesMutex.Unlock()
+	records, err := readRecordsFile(file)
+	if err != nil {
+		s.logger().Errorf("failed to read static records, keeping the previous ones of the file: %v", err)
+		return s.fileRecords[file]
+	}
+	if s.fileRecords == nil {
+		s.fileRecords = map[string][]config.StaticRecord{}
+	}
+	s.fileRecords[file] = records
+	return records
+}
+
+// GetDNSMap returns the feeds DNS map
+func (s *Static) GetDNSMap() map[string][]string {
+	return s.Feed.dnsMap()
+}
+
+// Watch reloads the files as soon as they change until stop is closed.
+// The directories of the files are watched, so files replaced by editors or
+// ConfigMap updates are picked up as well.
+func (s *Static) Watch(stop <-chan struct{}, changed func()) {
+	s.reload(changed)
+	if len(s.Files) == 0 {
+		return
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		s.logger().Errorf("failed to watch static record files, falling back to polling: %v", err)
+		Poll(s, pollInterval, stop, changed, s.logger())
+		return
+	}
+	defer watcher.Close()
+	dirs := map[string]bool{}
+	for _, file := range s.Files {
+		dir := filepath.Dir(file)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			s.logger().Errorf("failed to watch %s: %v", dir, err)
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				debugf(s.logger(), "static records file event %s", event)
+				s.reload(changed)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			s.logger().Errorf("watching static record files failed: %v", err)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// reload updates the records and notifies about the change
+func (s *Static) reload(changed func()) {
+	if err := s.Update(context.Background()); err != nil {
+		s.logger().Errorf("failed to update static records: %v", err)
+		return
+	}
+	changed()
+}
+
+// addRecords adds the records to the DNS map
+func (s *Static) addRecords(dnsMap map[string][]string, records []config.StaticRecord) {
+	for _, record := range records {
+		name := strings.TrimSuffix(strings.ToLower(record.Name), ".")
+		if name == "" {
+			continue
+		}
+		for _, address := range record.Addresses {
+			if net.ParseIP(address) == nil {
+				s.logger().Warningf("ignoring invalid address %q of static record %s", address, name)
+				continue
+			}
+			if !contains(dnsMap[name], address) {
+				dnsMap[name] = append(dnsMap[name], address)
+			}
+		}
+	}
+}
+
+// readRecordsFile reads a YAML file (.yaml or .yml) containing a list of records or a hosts file
+func readRecordsFile(file string) ([]config.StaticRecord, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read file %s err: %v", file, err)
+	}
+	switch filepath.Ext(file) {
+	case ".yaml", ".yml":
+		records := []config.StaticRecord{}
+		if err := yaml.Unmarshal(content, &records); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		return records, nil
+	default:
+		return parseHosts(content), nil
+	}
+}
+
+// parseHosts parses the hosts file format: '<address> <name> [<alias>...]'
+func parseHosts(content []byte) []config.StaticRecord {
+	records := []config.StaticRecord{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		for _, name := range fields[1:] {
+			records = append(records, config.StaticRecord{Name: name, Addresses: []string{fields[0]}})
+		}
+	}
+	return records
+}
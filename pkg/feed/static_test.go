@@ -0,0 +1,137 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package feed
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/feed/config"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testHosts = `# PLCs of line 1
+192.168.10.20  plc1.line1 plc1   # main controller
+192.168.10.21  plc2.line1
+fd00::20       plc1.line1
+not-an-ip      broken
+`
+	testRecordsYAML = `
+- name: gateway.plant
+  addresses:
+    - 192.168.10.1
+    - fd00::1
+`
+)
+
+func TestStaticUpdate(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	records := filepath.Join(dir, "records.yaml")
+	assert.Nil(ioutil.WriteFile(hosts, []byte(testHosts), 0600))
+	assert.Nil(ioutil.WriteFile(records, []byte(testRecordsYAML), 0600))
+
+	cfg := config.NewFeedConfig()
+	cfg.Static.Records = []config.StaticRecord{{Name: "Printer.Office.", Addresses: []string{"192.168.20.5"}}}
+	cfg.Static.Files = []string{hosts, records}
+	s := NewStatic(cfg)
+
+	assert.Nil(s.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"printer.office": {"192.168.20.5"},
+		"plc1.line1":     {"192.168.10.20", "fd00::20"},
+		"plc1":           {"192.168.10.20"},
+		"plc2.line1":     {"192.168.10.21"},
+		"gateway.plant":  {"192.168.10.1", "fd00::1"},
+	}, s.GetDNSMap())
+}
+
+func TestStaticUpdateBrokenFile(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	hosts := filepath.Join(dir, "hosts")
+	records := filepath.Join(dir, "records.yaml")
+	assert.Nil(ioutil.WriteFile(hosts, []byte("192.168.10.20 plc1\n"), 0600))
+
+	cfg := config.NewFeedConfig()
+	cfg.Static.Records = []config.StaticRecord{{Name: "printer.office", Addresses: []string{"192.168.20.5"}}}
+	cfg.Static.Files = []string{hosts, records}
+	s := NewStatic(cfg)
+
+	// a missing file doesn't hide the other records
+	assert.Nil(s.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"printer.office": {"192.168.20.5"},
+		"plc1":           {"192.168.10.20"},
+	}, s.GetDNSMap())
+
+	// a broken file keeps its last good records, the other files are read again
+	assert.Nil(ioutil.WriteFile(records, []byte("- name: plc2\n  addresses: [192.168.10.21]\n"), 0600))
+	assert.Nil(s.Update(context.Background()))
+	assert.Equal([]string{"192.168.10.21"}, s.GetDNSMap()["plc2"])
+	assert.Nil(ioutil.WriteFile(records, []byte("- name: [broken\n"), 0600))
+	assert.Nil(ioutil.WriteFile(hosts, []byte("192.168.10.30 plc1\n"), 0600))
+	assert.Nil(s.Update(context.Background()))
+	assert.Equal(map[string][]string{
+		"printer.office": {"192.168.20.5"},
+		"plc1":           {"192.168.10.30"},
+		"plc2":           {"192.168.10.21"},
+	}, s.GetDNSMap())
+}
+
+func TestStaticWatch(t *testing.T) {
+	assert := assert.New(t)
+	hosts := filepath.Join(t.TempDir(), "hosts")
+	assert.Nil(ioutil.WriteFile(hosts, []byte("192.168.10.20 plc1\n"), 0600))
+
+	cfg := config.NewFeedConfig()
+	cfg.Static.Files = []string{hosts}
+	s := NewStatic(cfg)
+	changed := make(chan struct{}, 10)
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(stop, func() { changed <- struct{}{} })
+
+	select {
+	case <-changed:
+		assert.Equal([]string{"192.168.10.20"}, s.GetDNSMap()["plc1"])
+	case <-time.After(time.Second):
+		t.Fatal("no initial update")
+	}
+
+	// a renamed file replaces the old one at once, like editors and ConfigMap updates do
+	tmp := filepath.Join(filepath.Dir(hosts), "hosts.tmp")
+	assert.Nil(ioutil.WriteFile(tmp, []byte("192.168.10.30 plc1\n"), 0600))
+	assert.Nil(os.Rename(tmp, hosts))
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-changed:
+			if ips := s.GetDNSMap()["plc1"]; len(ips) > 0 && ips[0] == "192.168.10.30" {
+				return
+			}
+		case <-timeout:
+			t.Fatal("file change not picked up")
+		}
+	}
+}
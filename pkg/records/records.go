@@ -0,0 +1,266 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package records
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Record is a single resource record of a name
+type Record struct {
+	// Name is the lower case name without trailing dot
+	Name string
+	// Type is the DNS record type, e.g. dns.TypeA
+	Type uint16
+	// Address is the address of A and AAAA records
+	Address net.IP
+	// Target is the name PTR, SRV and CNAME records point to. Targets of CNAME records
+	// that are not part of the snapshot are fully qualified names with a trailing dot.
+	Target string
+	// Port, Priority and Weight are the fields of SRV records
+	Port     uint16
+	Priority uint16
+	Weight   uint16
+	// Text contains the strings of TXT records
+	Text []string
+	// Source is the feed the record came from
+	Source string
+}
+
+// sameData reports whether both records have the same type and data
+func (r Record) sameData(other Record) bool {
+	return r.Type == other.Type && r.Address.Equal(other.Address) && r.Target == other.Target &&
+		r.Port == other.Port && r.Priority == other.Priority && r.Weight == other.Weight &&
+		equalText(r.Text, other.Text)
+}
+
+// equalText reports whether both lists of TXT strings are equal
+func equalText(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Snapshot is an immutable set of records. It is safe to be read concurrently.
+type Snapshot struct {
+	names map[string][]Record
+}
+
+// Lookup returns all records of a name and whether the name exists
+func (s *Snapshot) Lookup(name string) ([]Record, bool) {
+	records, ok := s.names[Normalize(name)]
+	return records, ok
+}
+
+// LookupType returns the records of a name with the given type and whether the name exists
+func (s *Snapshot) LookupType(name string, rrtype uint16) ([]Record, bool) {
+	all, ok := s.Lookup(name)
+	records := []Record{}
+	for _, record := range all {
+		if record.Type == rrtype {
+			records = append(records, record)
+		}
+	}
+	return records, ok
+}
+
+// Names returns all names of the snapshot in sorted order
+func (s *Snapshot) Names() []string {
+	names := make([]string, 0, len(s.names))
+	for name := range s.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the number of names in the snapshot
+func (s *Snapshot) Len() int {
+	return len(s.names)
+}
+
+// Builder collects records to build a snapshot
+type Builder struct {
+	names map[string][]Record
+}
+
+// NewBuilder creates a new, empty builder
+func NewBuilder() *Builder {
+	return &Builder{names: map[string][]Record{}}
+}
+
+// Add adds a record. Duplicates of records already added are ignored.
+func (b *Builder) Add(record Record) {
+	record.Name = Normalize(record.Name)
+	for _, existing := range b.names[record.Name] {
+		if existing.sameData(record) {
+			return
+		}
+	}
+	b.names[record.Name] = append(b.names[record.Name], record)
+}
+
+// AddAddress adds an A or AAAA record depending on the address family
+func (b *Builder) AddAddress(name string, address string, source string) error {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return fmt.Errorf("invalid address %q for %s", address, name)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b.Add(Record{Name: name, Type: mdns.TypeA, Address: ip4, Source: source})
+	} else {
+		b.Add(Record{Name: name, Type: mdns.TypeAAAA, Address: ip, Source: source})
+	}
+	return nil
+}
+
+// Build creates the snapshot. The builder must not be used afterwards.
+// A PTR record is added for each address of the A and AAAA records.
+func (b *Builder) Build() *Snapshot {
+	b.qualifyTargets()
+	b.addReverse()
+	snapshot := &Snapshot{names: b.names}
+	b.names = nil
+	return snapshot
+}
+
+// qualifyTargets marks the targets of CNAME records that are not part of the snapshot
+// as fully qualified names, they have to be resolved elsewhere
+func (b *Builder) qualifyTargets() {
+	for _, records := range b.names {
+		for i, record := range records {
+			if record.Type != mdns.TypeCNAME {
+				continue
+			}
+			target := Normalize(record.Target)
+			if _, ok := b.names[target]; ok {
+				records[i].Target = target
+			} else {
+				records[i].Target = mdns.Fqdn(target)
+			}
+		}
+	}
+}
+
+// addReverse adds one PTR record in in-addr.arpa or ip6.arpa for each address, pointing to the canonical
+// name of the address. Feeds define the canonical name by publishing the PTR record of their primary name
+// themselves, the first of them is kept if its name has the address. Otherwise the name with the fewest
+// labels is used, names with the same number of labels are ordered alphabetically.
+func (b *Builder) addReverse() {
+	canonical := map[string]Record{}
+	for name, records := range b.names {
+		for _, record := range records {
+			if record.Type != mdns.TypeA && record.Type != mdns.TypeAAAA {
+				continue
+			}
+			reverse, err := mdns.ReverseAddr(record.Address.String())
+			if err != nil {
+				continue
+			}
+			reverse = Normalize(reverse)
+			ptr := Record{Name: reverse, Type: mdns.TypePTR, Target: name, Source: record.Source}
+			if current, ok := canonical[reverse]; !ok || preferred(ptr.Target, current.Target) {
+				canonical[reverse] = ptr
+			}
+		}
+	}
+	for reverse, ptr := range canonical {
+		if published, ok := b.publishedPTR(reverse); ok {
+			ptr = published
+		}
+		b.names[reverse] = append(b.removeType(reverse, mdns.TypePTR), ptr)
+	}
+}
+
+// publishedPTR returns the first PTR record published for a reverse name whose target has the address
+func (b *Builder) publishedPTR(reverse string) (Record, bool) {
+	for _, ptr := range b.names[reverse] {
+		if ptr.Type != mdns.TypePTR {
+			continue
+		}
+		target := Normalize(ptr.Target)
+		for _, record := range b.names[target] {
+			if record.Type != mdns.TypeA && record.Type != mdns.TypeAAAA {
+				continue
+			}
+			if addr, err := mdns.ReverseAddr(record.Address.String()); err == nil && Normalize(addr) == reverse {
+				ptr.Target = target
+				return ptr, true
+			}
+		}
+	}
+	return Record{}, false
+}
+
+// removeType returns the records of a name without the ones of the type
+func (b *Builder) removeType(name string, rrtype uint16) []Record {
+	kept := []Record{}
+	for _, record := range b.names[name] {
+		if record.Type != rrtype {
+			kept = append(kept, record)
+		}
+	}
+	return kept
+}
+
+// preferred checks whether a name is preferred over another one as canonical name of an address
+func preferred(name string, other string) bool {
+	labels, otherLabels := mdns.CountLabel(name), mdns.CountLabel(other)
+	if labels != otherLabels {
+		return labels < otherLabels
+	}
+	return name < other
+}
+
+// Store holds the current snapshot. Lookups never block, updates replace the whole snapshot at once.
+type Store struct {
+	snapshot atomic.Value
+}
+
+// NewStore creates a store with an empty snapshot
+func NewStore() *Store {
+	s := &Store{}
+	s.Replace(NewBuilder().Build())
+	return s
+}
+
+// Load returns the current snapshot
+func (s *Store) Load() *Snapshot {
+	return s.snapshot.Load().(*Snapshot)
+}
+
+// Replace atomically swaps in a new snapshot
+func (s *Store) Replace(snapshot *Snapshot) {
+	s.snapshot.Store(snapshot)
+}
+
+// Normalize returns the lower case name without trailing dot
+func Normalize(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
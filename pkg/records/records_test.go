@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package records
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuilder(t *testing.T) {
+	assert := assert.New(t)
+	builder := NewBuilder()
+	assert.Nil(builder.AddAddress("Nginx.MyPod.", "172.17.0.2", "k8sapi"))
+	assert.Nil(builder.AddAddress("nginx.mypod", "fd00::2", "k8sapi"))
+	assert.Nil(builder.AddAddress("nginx.mypod", "172.17.0.2", "docker"))
+	assert.NotNil(builder.AddAddress("nginx.mypod", "not-an-ip", "k8sapi"))
+	snapshot := builder.Build()
+
+	all, ok := snapshot.Lookup("NGINX.mypod.")
+	assert.True(ok)
+	assert.Len(all, 2)
+	a, ok := snapshot.LookupType("nginx.mypod", mdns.TypeA)
+	assert.True(ok)
+	assert.Equal([]Record{{Name: "nginx.mypod", Type: mdns.TypeA, Address: a[0].Address, Source: "k8sapi"}}, a)
+	assert.Equal("172.17.0.2", a[0].Address.String())
+	mx, ok := snapshot.LookupType("nginx.mypod", mdns.TypeMX)
+	assert.True(ok)
+	assert.Empty(mx)
+	_, ok = snapshot.Lookup("unknown")
+	assert.False(ok)
+	assert.Equal([]string{
+		"2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa",
+		"2.0.17.172.in-addr.arpa",
+		"nginx.mypod",
+	}, snapshot.Names())
+}
+
+func TestBuilderReverse(t *testing.T) {
+	assert := assert.New(t)
+	builder := NewBuilder()
+	assert.Nil(builder.AddAddress("sidecar.mypod", "172.17.0.2", "k8sapi"))
+	assert.Nil(builder.AddAddress("nginx.mypod", "172.17.0.2", "k8sapi"))
+	snapshot := builder.Build()
+
+	ptr, ok := snapshot.LookupType("2.0.17.172.in-addr.arpa.", mdns.TypePTR)
+	assert.True(ok)
+	assert.Len(ptr, 1)
+	assert.Equal("nginx.mypod", ptr[0].Target)
+
+	// names with fewer labels are preferred
+	builder = NewBuilder()
+	assert.Nil(builder.AddAddress("nginx.mypod.default.pod", "172.17.0.2", "k8sapi"))
+	assert.Nil(builder.AddAddress("web", "172.17.0.2", "static"))
+	ptr, _ = builder.Build().LookupType("2.0.17.172.in-addr.arpa", mdns.TypePTR)
+	assert.Len(ptr, 1)
+	assert.Equal("web", ptr[0].Target)
+}
+
+func TestBuilderPublishedReverse(t *testing.T) {
+	assert := assert.New(t)
+	builder := NewBuilder()
+	assert.Nil(builder.AddAddress("nginx.mypod", "172.17.0.2", "k8sapi"))
+	assert.Nil(builder.AddAddress("sidecar.mypod", "172.17.0.2", "k8sapi"))
+	assert.Nil(builder.AddAddress("other.mypod", "172.17.0.3", "k8sapi"))
+	// the primary name of the feed wins, PTR records to names without the address are ignored
+	builder.Add(Record{Name: "2.0.17.172.in-addr.arpa.", Type: mdns.TypePTR, Target: "other.mypod", Source: "k8sapi"})
+	builder.Add(Record{Name: "2.0.17.172.in-addr.arpa.", Type: mdns.TypePTR, Target: "sidecar.mypod", Source: "k8sapi"})
+	builder.Add(Record{Name: "2.0.17.172.in-addr.arpa.", Type: mdns.TypePTR, Target: "nginx.mypod", Source: "k8sapi"})
+	snapshot := builder.Build()
+
+	ptr, _ := snapshot.LookupType("2.0.17.172.in-addr.arpa", mdns.TypePTR)
+	assert.Len(ptr, 1)
+	assert.Equal("sidecar.mypod", ptr[0].Target)
+	ptr, _ = snapshot.LookupType("3.0.17.172.in-addr.arpa", mdns.TypePTR)
+	assert.Len(ptr, 1)
+	assert.Equal("other.mypod", ptr[0].Target)
+}
+
+func TestBuilderService(t *testing.T) {
+	assert := assert.New(t)
+	builder := NewBuilder()
+	builder.Add(Record{Name: "_http._tcp.nginx.mypod", Type: mdns.TypeSRV, Target: "nginx.mypod", Port: 80, Source: "k8sapi"})
+	builder.Add(Record{Name: "_http._tcp.nginx.mypod", Type: mdns.TypeSRV, Target: "nginx.mypod", Port: 80, Source: "docker"})
+	builder.Add(Record{Name: "_http._tcp.nginx.mypod", Type: mdns.TypeSRV, Target: "nginx.mypod", Port: 8080, Source: "k8sapi"})
+	snapshot := builder.Build()
+
+	srv, ok := snapshot.LookupType("_http._tcp.nginx.mypod", mdns.TypeSRV)
+	assert.True(ok)
+	assert.Len(srv, 2)
+	assert.Equal(uint16(80), srv[0].Port)
+	assert.Equal(uint16(8080), srv[1].Port)
+}
+
+func TestBuilderCNAME(t *testing.T) {
+	assert := assert.New(t)
+	builder := NewBuilder()
+	assert.Nil(builder.AddAddress("backend.mypod", "172.17.0.2", "k8sapi"))
+	builder.Add(Record{Name: "api", Type: mdns.TypeCNAME, Target: "Backend.MyPod", Source: "k8sapi"})
+	builder.Add(Record{Name: "www", Type: mdns.TypeCNAME, Target: "example.com", Source: "k8sapi"})
+	snapshot := builder.Build()
+
+	api, _ := snapshot.LookupType("api", mdns.TypeCNAME)
+	assert.Equal("backend.mypod", api[0].Target)
+	www, _ := snapshot.LookupType("www", mdns.TypeCNAME)
+	assert.Equal("example.com.", www[0].Target)
+}
+
+func TestStoreConcurrentReplace(t *testing.T) {
+	store := NewStore()
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			builder := NewBuilder()
+			assert.Nil(t, builder.AddAddress("nginx.mypod", fmt.Sprintf("172.17.%d.%d", i/256, i%256), "test"))
+			store.Replace(builder.Build())
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if found, ok := store.Load().LookupType("nginx.mypod", mdns.TypeA); ok {
+				assert.Len(t, found, 1)
+			}
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,214 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+)
+
+// staleTTL is the TTL of records in stale answers as recommended by RFC 8767
+const staleTTL = 30
+
+// Upstream forwards DNS messages, e.g. to the nameservers of a Forwarder
+type Upstream interface {
+	Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error)
+}
+
+// Cache keeps the answers of an upstream until their records expire. Positive answers are kept for
+// the lowest TTL of their records, negative answers for the TTL of the SOA record (RFC 2308).
+// If serving stale answers is enabled, expired answers are used while the upstream fails (RFC 8767).
+type Cache struct {
+	upstream Upstream
+	config   config.CacheConfig
+	now      func() time.Time
+	log      Logger
+
+	// lru contains the entries, the most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	mutex   sync.Mutex
+}
+
+// cacheEntry is a cached answer
+type cacheEntry struct {
+	key      string
+	msg      *mdns.Msg
+	stored   time.Time
+	expires  time.Time
+	staleEnd time.Time
+}
+
+// NewCache creates a cache in front of the upstream
+func NewCache(upstream Upstream, config config.CacheConfig) *Cache {
+	return &Cache{
+		upstream: upstream,
+		config:   config,
+		now:      time.Now,
+		log:      klogLogger{},
+		lru:      list.New(),
+		entries:  map[string]*list.Element{},
+	}
+}
+
+// SetLogger sets the logger. It must be called before the cache is used.
+func (c *Cache) SetLogger(log Logger) {
+	c.log = log
+}
+
+// Forward answers the message from the cache or passes it to the upstream
+func (c *Cache) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	if len(r.Question) != 1 {
+		return c.upstream.Forward(ctx, r)
+	}
+	key := cacheKey(r)
+	now := c.now()
+	entry := c.get(key)
+	if entry != nil && now.Before(entry.expires) {
+		return entry.reply(r, uint32(now.Sub(entry.stored).Seconds()), false), nil
+	}
+
+	resp, err := c.upstream.Forward(ctx, r)
+	if err != nil || resp.Rcode == mdns.RcodeServerFailure || resp.Rcode == mdns.RcodeRefused {
+		if entry != nil && c.config.ServeStale && now.Before(entry.staleEnd) {
+			debugf(c.log, "serving stale answer of %s, upstream failed: %v", r.Question[0].Name, err)
+			return entry.reply(r, 0, true), nil
+		}
+		return resp, err
+	}
+	c.add(key, resp, now)
+	return resp, nil
+}
+
+// Len returns the number of cached answers
+func (c *Cache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.lru.Len()
+}
+
+// get returns the entry of the key and marks it as recently used
+func (c *Cache) get(key string) *cacheEntry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(element)
+	return element.Value.(*cacheEntry)
+}
+
+// add caches the response if it is cacheable and drops the least recently used answers beyond the size limit
+func (c *Cache) add(key string, resp *mdns.Msg, now time.Time) {
+	ttl, ok := cacheTTL(resp)
+	if !ok {
+		return
+	}
+	lifetime := time.Duration(ttl) * time.Second
+	if c.config.MaxTTL > 0 && lifetime > c.config.MaxTTL {
+		lifetime = c.config.MaxTTL
+	}
+	entry := &cacheEntry{
+		key:      key,
+		msg:      resp.Copy(),
+		stored:   now,
+		expires:  now.Add(lifetime),
+		staleEnd: now.Add(lifetime + c.config.StaleTTL),
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.config.Size > 0 && c.lru.Len() > c.config.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// reply creates a response to the request from the cached answer. The TTLs are reduced by the
+// age of the answer, stale answers use the TTL recommended by RFC 8767.
+func (e *cacheEntry) reply(r *mdns.Msg, age uint32, stale bool) *mdns.Msg {
+	msg := e.msg.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	for _, section := range [][]mdns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			hdr := rr.Header()
+			switch {
+			case hdr.Rrtype == mdns.TypeOPT:
+			case stale:
+				hdr.Ttl = staleTTL
+			case hdr.Ttl > age:
+				hdr.Ttl -= age
+			default:
+				hdr.Ttl = 0
+			}
+		}
+	}
+	return msg
+}
+
+// cacheKey identifies the question of a request, including the flags that change the answer
+func cacheKey(r *mdns.Msg) string {
+	question := r.Question[0]
+	do := false
+	if opt := r.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s/%d/%d/%t/%t", strings.ToLower(question.Name), question.Qtype, question.Qclass, do, r.CheckingDisabled)
+}
+
+// cacheTTL returns how long a response can be cached. Positive answers use the lowest TTL of their
+// answer and authority records, negative answers the TTL of the SOA record limited by its minimum.
+// Other responses, truncated ones and negative answers without SOA record are not cached.
+func cacheTTL(resp *mdns.Msg) (uint32, bool) {
+	if resp.Truncated || (resp.Rcode != mdns.RcodeSuccess && resp.Rcode != mdns.RcodeNameError) {
+		return 0, false
+	}
+	if resp.Rcode == mdns.RcodeSuccess && len(resp.Answer) > 0 {
+		ttl, found := uint32(0), false
+		for _, rr := range append(append([]mdns.RR{}, resp.Answer...), resp.Ns...) {
+			if !found || rr.Header().Ttl < ttl {
+				ttl, found = rr.Header().Ttl, true
+			}
+		}
+		return ttl, true
+	}
+	for _, rr := range resp.Ns {
+		if soa, ok := rr.(*mdns.SOA); ok {
+			if soa.Minttl < soa.Hdr.Ttl {
+				return soa.Minttl, true
+			}
+			return soa.Hdr.Ttl, true
+		}
+	}
+	return 0, false
+}
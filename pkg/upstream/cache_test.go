@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testUpstream answers A queries with a record of the given TTL and counts the queries
+type testUpstream struct {
+	queries int
+	rcode   int
+	fail    bool
+}
+
+func (u *testUpstream) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	u.queries++
+	if u.fail {
+		return nil, fmt.Errorf("uplink down")
+	}
+	msg := new(mdns.Msg)
+	msg.SetRcode(r, u.rcode)
+	if u.rcode == mdns.RcodeSuccess {
+		rr, _ := mdns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+	} else {
+		soa, _ := mdns.NewRR("example.com. 300 IN SOA ns.example.com. hostmaster.example.com. 1 3600 600 86400 10")
+		msg.Ns = append(msg.Ns, soa)
+	}
+	return msg, nil
+}
+
+func newTestCache(u Upstream, cfg config.CacheConfig) (*Cache, *time.Time) {
+	now := time.Now()
+	c := NewCache(u, cfg)
+	c.now = func() time.Time { return now }
+	return c, &now
+}
+
+func cacheQuery(t *testing.T, c *Cache, name string) *mdns.Msg {
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeA)
+	resp, err := c.Forward(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, req.Id, resp.Id)
+	return resp
+}
+
+func TestCacheHonoursTTL(t *testing.T) {
+	assert := assert.New(t)
+	u := &testUpstream{}
+	c, now := newTestCache(u, config.NewUpstreamConfig().Cache)
+
+	cacheQuery(t, c, "www.example.com.")
+	*now = now.Add(20 * time.Second)
+	resp := cacheQuery(t, c, "WWW.example.com.")
+	assert.Equal(1, u.queries)
+	assert.Equal(uint32(40), resp.Answer[0].Header().Ttl)
+	assert.Equal("WWW.example.com.", resp.Question[0].Name)
+
+	*now = now.Add(41 * time.Second)
+	cacheQuery(t, c, "www.example.com.")
+	assert.Equal(2, u.queries)
+}
+
+func TestCacheNegative(t *testing.T) {
+	assert := assert.New(t)
+	u := &testUpstream{rcode: mdns.RcodeNameError}
+	c, now := newTestCache(u, config.NewUpstreamConfig().Cache)
+
+	resp := cacheQuery(t, c, "typo.example.com.")
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+	resp = cacheQuery(t, c, "typo.example.com.")
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+	assert.Equal(1, u.queries)
+
+	// the SOA minimum limits the negative TTL
+	*now = now.Add(11 * time.Second)
+	cacheQuery(t, c, "typo.example.com.")
+	assert.Equal(2, u.queries)
+}
+
+func TestCacheServeStale(t *testing.T) {
+	assert := assert.New(t)
+	u := &testUpstream{}
+	cfg := config.NewUpstreamConfig().Cache
+	c, now := newTestCache(u, cfg)
+
+	cacheQuery(t, c, "www.example.com.")
+	u.fail = true
+	*now = now.Add(time.Hour)
+	resp := cacheQuery(t, c, "www.example.com.")
+	assert.Equal(uint32(staleTTL), resp.Answer[0].Header().Ttl)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("www.example.com.", mdns.TypeA)
+	c.config.ServeStale = false
+	_, err := c.Forward(context.Background(), req)
+	assert.NotNil(err)
+
+	c.config.ServeStale = true
+	*now = now.Add(cfg.StaleTTL)
+	_, err = c.Forward(context.Background(), req)
+	assert.NotNil(err)
+}
+
+func TestCacheSizeLimit(t *testing.T) {
+	assert := assert.New(t)
+	u := &testUpstream{}
+	cfg := config.NewUpstreamConfig().Cache
+	cfg.Size = 2
+	c, _ := newTestCache(u, cfg)
+
+	cacheQuery(t, c, "a.example.com.")
+	cacheQuery(t, c, "b.example.com.")
+	cacheQuery(t, c, "a.example.com.")
+	cacheQuery(t, c, "c.example.com.")
+	assert.Equal(2, c.Len())
+	assert.Equal(3, u.queries)
+
+	// b was the least recently used answer
+	cacheQuery(t, c, "a.example.com.")
+	assert.Equal(3, u.queries)
+	cacheQuery(t, c, "b.example.com.")
+	assert.Equal(4, u.queries)
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Coalescer passes only one of several identical queries to the upstream at a time. Queries for the
+// same name, type and class that arrive while the first one is in flight wait for its answer.
+type Coalescer struct {
+	upstream Upstream
+	calls    map[string]*call
+	mutex    sync.Mutex
+
+	forwarded uint64
+	coalesced uint64
+}
+
+// call is a query in flight
+type call struct {
+	done chan struct{}
+	resp *mdns.Msg
+	err  error
+}
+
+// CoalescerStats are the counters of a Coalescer
+type CoalescerStats struct {
+	// Forwarded is the number of queries passed to the upstream
+	Forwarded uint64
+	// Coalesced is the number of queries answered by waiting for an identical query
+	Coalesced uint64
+}
+
+// NewCoalescer creates a coalescer in front of the upstream
+func NewCoalescer(upstream Upstream) *Coalescer {
+	return &Coalescer{
+		upstream: upstream,
+		calls:    map[string]*call{},
+	}
+}
+
+// Forward passes the message to the upstream unless an identical query is in flight already.
+// Every caller gets its own copy of the response.
+func (c *Coalescer) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	if len(r.Question) != 1 {
+		return c.upstream.Forward(ctx, r)
+	}
+	key := cacheKey(r)
+	c.mutex.Lock()
+	if inflight, ok := c.calls[key]; ok {
+		c.mutex.Unlock()
+		atomic.AddUint64(&c.coalesced, 1)
+		select {
+		case <-inflight.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return inflight.reply(r)
+	}
+	inflight := &call{done: make(chan struct{})}
+	c.calls[key] = inflight
+	c.mutex.Unlock()
+
+	atomic.AddUint64(&c.forwarded, 1)
+	inflight.resp, inflight.err = c.upstream.Forward(ctx, r)
+	c.mutex.Lock()
+	delete(c.calls, key)
+	c.mutex.Unlock()
+	close(inflight.done)
+	return inflight.reply(r)
+}
+
+// Stats returns the counters
+func (c *Coalescer) Stats() CoalescerStats {
+	return CoalescerStats{
+		Forwarded: atomic.LoadUint64(&c.forwarded),
+		Coalesced: atomic.LoadUint64(&c.coalesced),
+	}
+}
+
+// reply returns a copy of the response for the request
+func (c *call) reply(r *mdns.Msg) (*mdns.Msg, error) {
+	if c.err != nil || c.resp == nil {
+		return nil, c.err
+	}
+	msg := c.resp.Copy()
+	msg.Id = r.Id
+	msg.Question = r.Question
+	return msg, nil
+}
@@ -0,0 +1,87 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingUpstream answers all queries once released
+type blockingUpstream struct {
+	release chan struct{}
+	queries int32
+}
+
+func (u *blockingUpstream) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	atomic.AddInt32(&u.queries, 1)
+	<-u.release
+	msg := new(mdns.Msg)
+	msg.SetReply(r)
+	rr, _ := mdns.NewRR(r.Question[0].Name + " 60 IN A 192.0.2.1")
+	msg.Answer = append(msg.Answer, rr)
+	return msg, nil
+}
+
+func TestCoalescer(t *testing.T) {
+	assert := assert.New(t)
+	u := &blockingUpstream{release: make(chan struct{})}
+	c := NewCoalescer(u)
+
+	const clients = 10
+	wg := sync.WaitGroup{}
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := new(mdns.Msg)
+			req.SetQuestion("www.example.com.", mdns.TypeA)
+			resp, err := c.Forward(context.Background(), req)
+			assert.Nil(err)
+			assert.Equal(req.Id, resp.Id)
+			assert.Len(resp.Answer, 1)
+		}()
+	}
+	for c.Stats().Coalesced < clients-1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// other types are not coalesced with the A queries
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		req := new(mdns.Msg)
+		req.SetQuestion("www.example.com.", mdns.TypeAAAA)
+		_, err := c.Forward(context.Background(), req)
+		assert.Nil(err)
+	}()
+	for atomic.LoadInt32(&u.queries) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(u.release)
+	wg.Wait()
+	<-done
+
+	assert.Equal(int32(2), atomic.LoadInt32(&u.queries))
+	assert.Equal(CoalescerStats{Forwarded: 2, Coalesced: clients - 1}, c.Stats())
+}
@@ -0,0 +1,147 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import "time"
+
+const (
+	// StrategySequential asks the nameservers one after the other in the configured order
+	StrategySequential = "sequential"
+	// StrategyRandom asks the nameservers one after the other in random order
+	StrategyRandom = "random"
+	// StrategyFastest asks the nameservers one after the other, the fastest first
+	StrategyFastest = "fastest"
+	// StrategyParallel asks all nameservers at once and uses the first answer
+	StrategyParallel = "parallel"
+)
+
+// UpstreamConfig specifies how queries are forwarded to the upstream nameservers
+type UpstreamConfig struct {
+	// Nameservers are the upstream nameservers. If empty, the other nameservers of resolv.conf are used.
+	// default: []
+	Nameservers []NameserverConfig `json:"nameservers"`
+	// Strategy defines the order the nameservers are asked in.
+	// One of sequential, random, fastest, parallel
+	// default: sequential
+	Strategy string `json:"strategy"`
+	// Timeout of a query to a nameserver without own timeout
+	// default: 5s
+	Timeout time.Duration `json:"timeout"`
+	// HealthCheck configures the health probes of the nameservers
+	HealthCheck HealthCheckConfig `json:"healthCheck"`
+	// Zones forward the queries of domains to their own nameservers. The longest matching domain is used.
+	// default: []
+	Zones []ZoneConfig `json:"zones"`
+	// Coalesce passes only one of several identical queries in flight to the nameservers,
+	// the others wait for its answer
+	// default: true
+	Coalesce bool `json:"coalesce"`
+	// Cache configures the cache of upstream answers
+	Cache CacheConfig `json:"cache"`
+}
+
+// NameserverConfig specifies an upstream nameserver
+type NameserverConfig struct {
+	// Address of the nameserver as host or host:port. The port defaults to 53.
+	// tls://host[:port] uses DNS over TLS, the port defaults to 853.
+	// https://host[:port][/path] uses DNS over HTTPS, the path defaults to /dns-query.
+	Address string `json:"address"`
+	// Timeout of a query to this nameserver, 0 uses the timeout of the upstream configuration
+	// default: 0
+	Timeout time.Duration `json:"timeout"`
+	// ServerName is sent using SNI and verified against the certificate of tls:// and https:// nameservers
+	// default: the host of the address
+	ServerName string `json:"serverName"`
+	// Pins are the base64 encoded SHA-256 digests of the public keys (SPKI) accepted for tls:// and https://
+	// nameservers. If set, the certificate is not verified against the CAs, its key must match or it must be issued
+	// for the server name by a pinned intermediate or CA.
+	// default: []
+	Pins []string `json:"pins"`
+	// CAFile is a PEM file with the CA certificates used to verify tls:// and https:// nameservers
+	// default: "", uses the CAs of the system
+	CAFile string `json:"caFile"`
+}
+
+// ZoneConfig specifies the nameservers of a domain
+type ZoneConfig struct {
+	// Domain whose queries, including the ones of its subdomains, are forwarded to the nameservers of the zone
+	Domain string `json:"domain"`
+	// Nameservers of the domain
+	Nameservers []NameserverConfig `json:"nameservers"`
+	// Strategy of the nameservers, empty uses the strategy of the upstream configuration
+	// default: ""
+	Strategy string `json:"strategy"`
+	// NoForward answers the queries of the domain with NXDOMAIN instead of forwarding them, e.g. for private names
+	// default: false
+	NoForward bool `json:"noForward"`
+}
+
+// HealthCheckConfig specifies the health probes of the nameservers. Nameservers failing too often are
+// taken out of rotation until a probe succeeds again. If all nameservers are down, all of them are used.
+type HealthCheckConfig struct {
+	// Interval between the probes, 0 disables them
+	// default: 10s
+	Interval time.Duration `json:"interval"`
+	// FailureThreshold is the number of failures in a row that takes a nameserver out of rotation
+	// default: 3
+	FailureThreshold int `json:"failureThreshold"`
+	// Name is queried for its NS records by the probes
+	// default: .
+	Name string `json:"name"`
+}
+
+// CacheConfig specifies the cache of upstream answers
+type CacheConfig struct {
+	// Enabled indicates if upstream answers are cached
+	// default: true
+	Enabled bool `json:"enabled"`
+	// Size is the maximum number of cached answers, the least recently used answers are dropped first
+	// default: 10000
+	Size int `json:"size"`
+	// MaxTTL limits the time answers are cached, regardless of the TTL of their records
+	// default: 1h
+	MaxTTL time.Duration `json:"maxTTL"`
+	// ServeStale enables serving expired answers while the upstream nameservers are unreachable (RFC 8767)
+	// default: true
+	ServeStale bool `json:"serveStale"`
+	// StaleTTL is how long expired answers are kept to be served stale
+	// default: 24h
+	StaleTTL time.Duration `json:"staleTTL"`
+}
+
+// NewUpstreamConfig returns a default UpstreamConfig
+func NewUpstreamConfig() *UpstreamConfig {
+	return &UpstreamConfig{
+		Nameservers: []NameserverConfig{},
+		Strategy:    StrategySequential,
+		Timeout:     5 * time.Second,
+		Zones:       []ZoneConfig{},
+		HealthCheck: HealthCheckConfig{
+			Interval:         10 * time.Second,
+			FailureThreshold: 3,
+			Name:             ".",
+		},
+		Coalesce: true,
+		Cache: CacheConfig{
+			Enabled:    true,
+			Size:       10000,
+			MaxTTL:     time.Hour,
+			ServeStale: true,
+			StaleTTL:   24 * time.Hour,
+		},
+	}
+}
@@ -0,0 +1,368 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+)
+
+const (
+	defaultPort    = "53"
+	defaultTimeout = 5 * time.Second
+)
+
+// Forwarder passes DNS messages unchanged to upstream nameservers
+type Forwarder struct {
+	strategy    string
+	timeout     time.Duration
+	healthCheck config.HealthCheckConfig
+	servers     atomic.Value
+	log         Logger
+}
+
+// server is an upstream nameserver together with its health
+type server struct {
+	address   string
+	config    config.NameserverConfig
+	timeout   time.Duration
+	transport transport
+	// failures counts the failed queries in a row
+	failures int32
+	// rtt is the moving average of the round trip time in nanoseconds
+	rtt int64
+}
+
+// result is the outcome of a query to a server
+type result struct {
+	resp *mdns.Msg
+	err  error
+}
+
+// NewForwarder creates a new Forwarder asking the nameservers in order
+func NewForwarder(nameservers []string) *Forwarder {
+	defaults := config.NewUpstreamConfig()
+	f := &Forwarder{
+		strategy:    config.StrategySequential,
+		timeout:     defaultTimeout,
+		healthCheck: defaults.HealthCheck,
+		log:         klogLogger{},
+	}
+	f.SetNameservers(nameservers)
+	return f
+}
+
+// NewForwarderFromConfig creates a new Forwarder using the configured nameservers and strategy
+func NewForwarderFromConfig(cfg *config.UpstreamConfig) (*Forwarder, error) {
+	switch cfg.Strategy {
+	case config.StrategySequential, config.StrategyRandom, config.StrategyFastest, config.StrategyParallel:
+	default:
+		return nil, fmt.Errorf("unknown upstream strategy %q", cfg.Strategy)
+	}
+	f := &Forwarder{
+		strategy:    cfg.Strategy,
+		timeout:     cfg.Timeout,
+		healthCheck: cfg.HealthCheck,
+		log:         klogLogger{},
+	}
+	if f.timeout <= 0 {
+		f.timeout = defaultTimeout
+	}
+	if err := f.setServers(cfg.Nameservers); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// SetLogger sets the logger. It must be called before the forwarder is used.
+func (f *Forwarder) SetLogger(log Logger) {
+	f.log = log
+}
+
+// SetNameservers replaces the nameservers. It is safe to be called while queries are forwarded.
+// The health of nameservers that are kept is preserved.
+func (f *Forwarder) SetNameservers(nameservers []string) {
+	configs := make([]config.NameserverConfig, 0, len(nameservers))
+	for _, nameserver := range nameservers {
+		configs = append(configs, config.NameserverConfig{Address: nameserver})
+	}
+	if err := f.setServers(configs); err != nil {
+		f.log.Errorf("cannot set upstream nameservers: %v", err)
+	}
+}
+
+// setServers replaces the servers, reusing the existing ones with the same configuration.
+// The idle connections of the servers that are dropped are closed.
+func (f *Forwarder) setServers(configs []config.NameserverConfig) error {
+	existing := map[string]*server{}
+	for _, s := range f.currentServers() {
+		existing[s.address] = s
+	}
+	servers := make([]*server, 0, len(configs))
+	for _, c := range configs {
+		timeout := c.Timeout
+		if timeout <= 0 {
+			timeout = f.timeout
+		}
+		addr, transport, err := newTransport(c, timeout)
+		if err != nil {
+			return err
+		}
+		if s, ok := existing[addr]; ok && s.timeout == timeout && reflect.DeepEqual(s.config, c) {
+			transport.close()
+			delete(existing, addr)
+			servers = append(servers, s)
+			continue
+		}
+		servers = append(servers, &server{
+			address:   addr,
+			config:    c,
+			timeout:   timeout,
+			transport: transport,
+		})
+	}
+	f.servers.Store(servers)
+	for _, s := range existing {
+		s.transport.close()
+	}
+	return nil
+}
+
+// currentServers returns the current servers
+func (f *Forwarder) currentServers() []*server {
+	servers, _ := f.servers.Load().([]*server)
+	return servers
+}
+
+// Nameservers returns the addresses of the current nameservers
+func (f *Forwarder) Nameservers() []string {
+	nameservers := []string{}
+	for _, s := range f.currentServers() {
+		nameservers = append(nameservers, s.address)
+	}
+	return nameservers
+}
+
+// Healthy returns the addresses of the nameservers that are in rotation
+func (f *Forwarder) Healthy() []string {
+	healthy := []string{}
+	for _, s := range f.currentServers() {
+		if !f.down(s) {
+			healthy = append(healthy, s.address)
+		}
+	}
+	return healthy
+}
+
+// Forward sends the message to the nameservers in the order of the strategy and returns the first
+// usable response. Responses are returned as they are, including all sections and the rcode. Only
+// SERVFAIL and REFUSED responses make the next nameserver being asked. Queries in flight are
+// interrupted as soon as the context is done.
+func (f *Forwarder) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	servers := f.rotation()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no upstream nameservers configured")
+	}
+	if f.strategy == config.StrategyParallel {
+		return f.race(ctx, r, servers)
+	}
+	var lastResp *mdns.Msg
+	var lastErr error
+	for _, s := range servers {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		resp, err := f.exchange(ctx, s, r)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			f.log.Infof("cannot forward %s to %s, err: %v", r.Question[0].Name, s.address, err)
+			lastErr = err
+			continue
+		}
+		if !usable(resp) {
+			lastResp = resp
+			continue
+		}
+		return resp, nil
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// race sends the message to all servers at once and returns the first usable response.
+// The queries still in flight are interrupted once it returned.
+func (f *Forwarder) race(ctx context.Context, r *mdns.Msg, servers []*server) (*mdns.Msg, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(servers))
+	for _, s := range servers {
+		go func(s *server, r *mdns.Msg) {
+			resp, err := f.exchange(ctx, s, r)
+			results <- result{resp: resp, err: err}
+		}(s, r.Copy())
+	}
+	var lastResp *mdns.Msg
+	var lastErr error
+	for range servers {
+		var res result
+		select {
+		case res = <-results:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		switch {
+		case res.err != nil:
+			lastErr = res.err
+		case !usable(res.resp):
+			lastResp = res.resp
+		default:
+			return res.resp, nil
+		}
+	}
+	if lastResp != nil {
+		return lastResp, nil
+	}
+	return nil, lastErr
+}
+
+// rotation returns the servers in rotation in the order of the strategy. If all servers are down, all are used.
+func (f *Forwarder) rotation() []*server {
+	all := f.currentServers()
+	servers := make([]*server, 0, len(all))
+	for _, s := range all {
+		if !f.down(s) {
+			servers = append(servers, s)
+		}
+	}
+	if len(servers) == 0 {
+		servers = append(servers, all...)
+	}
+	switch f.strategy {
+	case config.StrategyRandom:
+		rand.Shuffle(len(servers), func(i, j int) {
+			servers[i], servers[j] = servers[j], servers[i]
+		})
+	case config.StrategyFastest:
+		sort.SliceStable(servers, func(i, j int) bool {
+			return atomic.LoadInt64(&servers[i].rtt) < atomic.LoadInt64(&servers[j].rtt)
+		})
+	}
+	return servers
+}
+
+// exchange sends the message to the server and records the outcome for its health.
+// Queries interrupted by the context don't count as failures of the server.
+func (f *Forwarder) exchange(ctx context.Context, s *server, r *mdns.Msg) (*mdns.Msg, error) {
+	start := time.Now()
+	resp, err := s.transport.exchange(ctx, r)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	f.report(s, err == nil, time.Since(start))
+	return resp, err
+}
+
+// report updates the health of a server after a query
+func (f *Forwarder) report(s *server, ok bool, rtt time.Duration) {
+	if !ok {
+		failures := atomic.AddInt32(&s.failures, 1)
+		if f.healthCheck.Interval > 0 && int(failures) == f.healthCheck.FailureThreshold {
+			f.log.Warningf("upstream nameserver %s is down after %d failures", s.address, failures)
+		}
+		return
+	}
+	if f.down(s) {
+		f.log.Infof("upstream nameserver %s is up again", s.address)
+	}
+	atomic.StoreInt32(&s.failures, 0)
+	old := atomic.LoadInt64(&s.rtt)
+	if old == 0 {
+		atomic.StoreInt64(&s.rtt, int64(rtt))
+	} else {
+		atomic.StoreInt64(&s.rtt, (7*old+int64(rtt))/8)
+	}
+}
+
+// down checks whether a server is out of rotation. Without health probes servers are never taken
+// out of rotation, as nothing would bring them back.
+func (f *Forwarder) down(s *server) bool {
+	if f.healthCheck.Interval <= 0 || f.healthCheck.FailureThreshold <= 0 {
+		return false
+	}
+	return int(atomic.LoadInt32(&s.failures)) >= f.healthCheck.FailureThreshold
+}
+
+// Probe queries all nameservers every interval of the health check until the context is cancelled.
+// Failing nameservers are taken out of rotation, they are put back as soon as a probe succeeds.
+func (f *Forwarder) Probe(ctx context.Context) {
+	if f.healthCheck.Interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(f.healthCheck.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			f.probe(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// probe sends a probe to all servers at once and waits for the results
+func (f *Forwarder) probe(ctx context.Context) {
+	wg := sync.WaitGroup{}
+	for _, s := range f.currentServers() {
+		wg.Add(1)
+		go func(s *server) {
+			defer wg.Done()
+			probe := new(mdns.Msg)
+			probe.SetQuestion(mdns.Fqdn(f.healthCheck.Name), mdns.TypeNS)
+			start := time.Now()
+			resp, err := s.transport.exchange(ctx, probe)
+			if ctx.Err() != nil {
+				return
+			}
+			f.report(s, err == nil && usable(resp), time.Since(start))
+		}(s)
+	}
+	wg.Wait()
+}
+
+// usable checks whether the response can be returned, SERVFAIL and REFUSED make the next nameserver being asked
+func usable(resp *mdns.Msg) bool {
+	return resp.Rcode != mdns.RcodeServerFailure && resp.Rcode != mdns.RcodeRefused
+}
+
+// address adds the default DNS port to a nameserver if it has none
+func address(nameserver string) string {
+	return withPort(nameserver, defaultPort)
+}
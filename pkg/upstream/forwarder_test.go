@@ -0,0 +1,271 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// startTestServer starts a DNS server on a random local port for UDP and TCP
+func startTestServer(t *testing.T, handler mdns.HandlerFunc) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &mdns.Server{PacketConn: pc, Handler: handler}
+	tcp := &mdns.Server{Listener: l, Handler: handler}
+	go func() { _ = udp.ActivateAndServe() }()
+	go func() { _ = tcp.ActivateAndServe() }()
+	t.Cleanup(func() {
+		_ = udp.Shutdown()
+		_ = tcp.Shutdown()
+	})
+	return pc.LocalAddr().String()
+}
+
+func rcodeHandler(rcode int) mdns.HandlerFunc {
+	return func(w mdns.ResponseWriter, r *mdns.Msg) {
+		msg := new(mdns.Msg)
+		msg.SetRcode(r, rcode)
+		_ = w.WriteMsg(msg)
+	}
+}
+
+func TestForwardReturnsAllSections(t *testing.T) {
+	assert := assert.New(t)
+	addr := startTestServer(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		msg := new(mdns.Msg)
+		msg.SetReply(r)
+		mx, _ := mdns.NewRR("example.com. 1234 IN MX 10 mail.example.com.")
+		ns, _ := mdns.NewRR("example.com. 300 IN NS ns1.example.com.")
+		a, _ := mdns.NewRR("mail.example.com. 60 IN A 192.0.2.1")
+		msg.Answer = []mdns.RR{mx}
+		msg.Ns = []mdns.RR{ns}
+		msg.Extra = []mdns.RR{a}
+		_ = w.WriteMsg(msg)
+	})
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeMX)
+	resp, err := NewForwarder([]string{addr}).Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(req.Id, resp.Id)
+	assert.Len(resp.Answer, 1)
+	assert.Equal(uint32(1234), resp.Answer[0].Header().Ttl)
+	assert.Len(resp.Ns, 1)
+	assert.Len(resp.Extra, 1)
+}
+
+func TestForwardKeepsNXDomain(t *testing.T) {
+	assert := assert.New(t)
+	nx := startTestServer(t, rcodeHandler(mdns.RcodeNameError))
+	other := startTestServer(t, rcodeHandler(mdns.RcodeSuccess))
+
+	req := new(mdns.Msg)
+	req.SetQuestion("impossibledomain.", mdns.TypeA)
+	resp, err := NewForwarder([]string{nx, other}).Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(mdns.RcodeNameError, resp.Rcode)
+}
+
+func TestForwardSkipsFailingNameservers(t *testing.T) {
+	assert := assert.New(t)
+	failing := startTestServer(t, rcodeHandler(mdns.RcodeServerFailure))
+	working := startTestServer(t, rcodeHandler(mdns.RcodeSuccess))
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeTXT)
+	resp, err := NewForwarder([]string{failing, working}).Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+
+	resp, err = NewForwarder([]string{failing}).Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(mdns.RcodeServerFailure, resp.Rcode)
+
+	_, err = NewForwarder(nil).Forward(context.Background(), req)
+	assert.NotNil(err)
+}
+
+func TestForwardRetriesTruncatedOverTCP(t *testing.T) {
+	assert := assert.New(t)
+	addr := startTestServer(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		msg := new(mdns.Msg)
+		msg.SetReply(r)
+		if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+			msg.Truncated = true
+		} else {
+			txt, _ := mdns.NewRR(`example.com. 60 IN TXT "via tcp"`)
+			msg.Answer = []mdns.RR{txt}
+		}
+		_ = w.WriteMsg(msg)
+	})
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeTXT)
+	resp, err := NewForwarder([]string{addr}).Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.False(resp.Truncated)
+	assert.Len(resp.Answer, 1)
+}
+
+// startDeadServer returns the address of a UDP socket that never answers
+func startDeadServer(t *testing.T) string {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return pc.LocalAddr().String()
+}
+
+// countingHandler answers successfully after the delay and counts the queries
+func countingHandler(count *int32, delay time.Duration) mdns.HandlerFunc {
+	return func(w mdns.ResponseWriter, r *mdns.Msg) {
+		atomic.AddInt32(count, 1)
+		time.Sleep(delay)
+		rcodeHandler(mdns.RcodeSuccess)(w, r)
+	}
+}
+
+func newTestUpstreamConfig(strategy string, nameservers ...string) *config.UpstreamConfig {
+	cfg := config.NewUpstreamConfig()
+	cfg.Strategy = strategy
+	cfg.Timeout = 200 * time.Millisecond
+	cfg.HealthCheck.FailureThreshold = 1
+	for _, nameserver := range nameservers {
+		cfg.Nameservers = append(cfg.Nameservers, config.NameserverConfig{Address: nameserver})
+	}
+	return cfg
+}
+
+func TestForwardFastestFirst(t *testing.T) {
+	assert := assert.New(t)
+	var slowCount, fastCount int32
+	slow := startTestServer(t, countingHandler(&slowCount, 50*time.Millisecond))
+	fast := startTestServer(t, countingHandler(&fastCount, 0))
+	f, err := NewForwarderFromConfig(newTestUpstreamConfig(config.StrategyFastest, slow, fast))
+	assert.Nil(err)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	// measure both nameservers first
+	f.probe(context.Background())
+	for i := 0; i < 5; i++ {
+		_, err := f.Forward(context.Background(), req)
+		assert.Nil(err)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&slowCount))
+	assert.Equal(int32(6), atomic.LoadInt32(&fastCount))
+}
+
+func TestForwardParallelRace(t *testing.T) {
+	assert := assert.New(t)
+	dead := startDeadServer(t)
+	var count int32
+	working := startTestServer(t, countingHandler(&count, 0))
+	cfg := newTestUpstreamConfig(config.StrategyParallel, dead, working)
+	cfg.Timeout = 2 * time.Second
+	f, err := NewForwarderFromConfig(cfg)
+	assert.Nil(err)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	start := time.Now()
+	resp, err := f.Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(req.Id, resp.Id)
+	assert.Less(int64(time.Since(start)), int64(time.Second))
+}
+
+// forwardCancelled forwards a query that is cancelled after a short time and returns how long it took
+func forwardCancelled(t *testing.T, f *Forwarder) time.Duration {
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := f.Forward(ctx, req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+	return time.Since(start)
+}
+
+func TestForwardCancel(t *testing.T) {
+	assert := assert.New(t)
+	dead := startDeadServer(t)
+	for _, strategy := range []string{config.StrategySequential, config.StrategyParallel} {
+		cfg := newTestUpstreamConfig(strategy, dead, dead)
+		cfg.Timeout = 5 * time.Second
+		f, err := NewForwarderFromConfig(cfg)
+		assert.Nil(err)
+
+		assert.Less(int64(forwardCancelled(t, f)), int64(time.Second), strategy)
+		// interrupted queries are no failures of the nameservers
+		assert.Equal([]string{dead, dead}, f.Healthy(), strategy)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	assert := assert.New(t)
+	var refusing int32 = 1
+	flaky := startTestServer(t, func(w mdns.ResponseWriter, r *mdns.Msg) {
+		if atomic.LoadInt32(&refusing) == 1 {
+			rcodeHandler(mdns.RcodeRefused)(w, r)
+			return
+		}
+		rcodeHandler(mdns.RcodeSuccess)(w, r)
+	})
+	dead := startDeadServer(t)
+	var count int32
+	working := startTestServer(t, countingHandler(&count, 0))
+	f, err := NewForwarderFromConfig(newTestUpstreamConfig(config.StrategySequential, dead, flaky, working))
+	assert.Nil(err)
+
+	f.probe(context.Background())
+	assert.Equal([]string{working}, f.Healthy())
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	resp, err := f.Forward(context.Background(), req)
+	assert.Nil(err)
+	assert.Equal(mdns.RcodeSuccess, resp.Rcode)
+
+	atomic.StoreInt32(&refusing, 0)
+	f.probe(context.Background())
+	assert.Equal([]string{flaky, working}, f.Healthy())
+
+	_, err = NewForwarderFromConfig(newTestUpstreamConfig("unknown"))
+	assert.NotNil(err)
+}
+
+func TestAddress(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("8.8.8.8:53", address("8.8.8.8"))
+	assert.Equal("8.8.8.8:5353", address("8.8.8.8:5353"))
+	assert.Equal("[2001:db8::1]:53", address("2001:db8::1"))
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// httpsTransport sends messages using DNS over HTTPS (RFC 8484). The connections are kept open by the
+// HTTP transport, using HTTP/2 if the nameserver supports it.
+type httpsTransport struct {
+	url       string
+	client    *http.Client
+	transport *http.Transport
+}
+
+func newHTTPSTransport(url string, tlsConfig *tls.Config, timeout time.Duration) *httpsTransport {
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: timeout}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: timeout,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     idleTimeout,
+	}
+	return &httpsTransport{
+		url:       url,
+		client:    &http.Client{Transport: transport, Timeout: timeout},
+		transport: transport,
+	}
+}
+
+// exchange posts the message to the nameserver. The message id is sent as 0 to make the
+// responses cacheable by HTTP caches, as recommended by RFC 8484.
+func (t *httpsTransport) exchange(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	query := r.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.url, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageType)
+	req.Header.Set("Accept", dnsMessageType)
+	httpResp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, httpResp.Body)
+		return nil, fmt.Errorf("unexpected http status %s", httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, mdns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+	resp := new(mdns.Msg)
+	if err := resp.Unpack(body); err != nil {
+		return nil, err
+	}
+	resp.Id = r.Id
+	return resp, nil
+}
+
+func (t *httpsTransport) close() {
+	t.transport.CloseIdleConnections()
+}
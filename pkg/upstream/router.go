@@ -0,0 +1,95 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	mdns "github.com/miekg/dns"
+)
+
+// Router forwards the queries of domains to their own upstreams. The route of the longest
+// matching domain is used, queries of other names are passed to the fallback.
+type Router struct {
+	fallback Upstream
+	routes   []route
+	mutex    sync.RWMutex
+}
+
+// route is a domain with its upstream, a nil upstream never forwards the queries of the domain
+type route struct {
+	domain   string
+	upstream Upstream
+}
+
+// NewRouter creates a router passing the queries without route to the fallback
+func NewRouter(fallback Upstream) *Router {
+	return &Router{fallback: fallback}
+}
+
+// Add routes the queries of the domain and its subdomains to the upstream. If the upstream
+// is nil, the queries are answered with NXDOMAIN instead of being forwarded.
+func (r *Router) Add(domain string, upstream Upstream) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.routes = append(r.routes, route{domain: strings.ToLower(mdns.Fqdn(domain)), upstream: upstream})
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return mdns.CountLabel(r.routes[i].domain) > mdns.CountLabel(r.routes[j].domain)
+	})
+}
+
+// Forward passes the message to the upstream of the longest matching domain
+func (r *Router) Forward(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	if len(m.Question) == 0 {
+		return r.forwardFallback(ctx, m)
+	}
+	route, ok := r.match(m.Question[0].Name)
+	if !ok {
+		return r.forwardFallback(ctx, m)
+	}
+	if route.upstream == nil {
+		msg := new(mdns.Msg)
+		msg.SetRcode(m, mdns.RcodeNameError)
+		return msg, nil
+	}
+	return route.upstream.Forward(ctx, m)
+}
+
+// match returns the route of the longest domain the name belongs to
+func (r *Router) match(name string) (route, bool) {
+	name = strings.ToLower(mdns.Fqdn(name))
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, route := range r.routes {
+		if mdns.IsSubDomain(route.domain, name) {
+			return route, true
+		}
+	}
+	return route{}, false
+}
+
+// forwardFallback passes the message to the fallback
+func (r *Router) forwardFallback(ctx context.Context, m *mdns.Msg) (*mdns.Msg, error) {
+	if r.fallback == nil {
+		return nil, fmt.Errorf("no upstream nameservers configured")
+	}
+	return r.fallback.Forward(ctx, m)
+}
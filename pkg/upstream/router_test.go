@@ -0,0 +1,80 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// namedUpstream answers every query with a TXT record containing its name
+type namedUpstream string
+
+func (u namedUpstream) Forward(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	msg := new(mdns.Msg)
+	msg.SetReply(r)
+	msg.Answer = append(msg.Answer, &mdns.TXT{
+		Hdr: mdns.RR_Header{Name: r.Question[0].Name, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET},
+		Txt: []string{string(u)},
+	})
+	return msg, nil
+}
+
+func routeOf(t *testing.T, r *Router, name string) (string, int) {
+	req := new(mdns.Msg)
+	req.SetQuestion(name, mdns.TypeTXT)
+	resp, err := r.Forward(context.Background(), req)
+	assert.Nil(t, err)
+	if len(resp.Answer) == 0 {
+		return "", resp.Rcode
+	}
+	return resp.Answer[0].(*mdns.TXT).Txt[0], resp.Rcode
+}
+
+func TestRouter(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRouter(namedUpstream("default"))
+	r.Add("plant.local", namedUpstream("plc"))
+	r.Add("line1.plant.local.", namedUpstream("line1"))
+	r.Add("corp.example", namedUpstream("vpn"))
+	r.Add("private.lan", nil)
+
+	for name, expected := range map[string]string{
+		"plc1.plant.local.":       "plc",
+		"plant.local.":            "plc",
+		"PLC1.Line1.Plant.Local.": "line1",
+		"www.corp.example.":       "vpn",
+		"example.com.":            "default",
+		"notplant.local.":         "default",
+	} {
+		upstream, rcode := routeOf(t, r, name)
+		assert.Equal(expected, upstream, name)
+		assert.Equal(mdns.RcodeSuccess, rcode, name)
+	}
+
+	upstream, rcode := routeOf(t, r, "nas.private.lan.")
+	assert.Empty(upstream)
+	assert.Equal(mdns.RcodeNameError, rcode)
+
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeA)
+	_, err := NewRouter(nil).Forward(context.Background(), req)
+	assert.NotNil(err)
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	mdns "github.com/miekg/dns"
+)
+
+// tlsTransport sends messages using DNS over TLS (RFC 7858). Connections are kept open and reused.
+type tlsTransport struct {
+	address   string
+	tlsConfig *tls.Config
+	timeout   time.Duration
+
+	mutex  sync.Mutex
+	idle   []*tlsConn
+	closed bool
+}
+
+// tlsConn is an open connection to the nameserver
+type tlsConn struct {
+	*mdns.Conn
+	lastUsed time.Time
+}
+
+func newTLSTransport(address string, tlsConfig *tls.Config, timeout time.Duration) *tlsTransport {
+	return &tlsTransport{
+		address:   address,
+		tlsConfig: tlsConfig,
+		timeout:   timeout,
+	}
+}
+
+// exchange sends the message using an idle connection or a new one. As the nameserver may have closed
+// an idle connection in the meantime, failed queries on reused connections are retried on a new one.
+func (t *tlsTransport) exchange(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	if conn := t.get(); conn != nil {
+		resp, err := t.exchangeOn(ctx, conn, r)
+		if err == nil || ctx.Err() != nil {
+			return resp, err
+		}
+	}
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return t.exchangeOn(ctx, conn, r)
+}
+
+// exchangeOn sends the message on the connection and puts it back to the idle ones if it succeeded.
+// The connection is closed if the context is done before the response arrived.
+func (t *tlsTransport) exchangeOn(ctx context.Context, conn *tlsConn, r *mdns.Msg) (*mdns.Msg, error) {
+	stop := closeOnDone(ctx, conn)
+	resp, err := t.roundTrip(ctx, conn, r)
+	if stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	t.put(conn)
+	return resp, nil
+}
+
+// roundTrip writes the message and reads the response within the timeout or the deadline of the context
+func (t *tlsTransport) roundTrip(ctx context.Context, conn *tlsConn, r *mdns.Msg) (*mdns.Msg, error) {
+	deadline := time.Now().Add(t.timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+	if err := conn.WriteMsg(r); err != nil {
+		return nil, err
+	}
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if resp.Id != r.Id {
+		return nil, fmt.Errorf("response id %d does not match the query id %d", resp.Id, r.Id)
+	}
+	return resp, nil
+}
+
+// dial opens a new connection, the TLS handshake is part of the timeout
+func (t *tlsTransport) dial(ctx context.Context) (*tlsConn, error) {
+	dialer := &tls.Dialer{NetDialer: &net.Dialer{Timeout: t.timeout}, Config: t.tlsConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsConn{Conn: &mdns.Conn{Conn: conn}}, nil
+}
+
+// get returns the most recently used idle connection. Connections idle for too long are closed.
+func (t *tlsTransport) get() *tlsConn {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for len(t.idle) > 0 {
+		conn := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		if time.Since(conn.lastUsed) < idleTimeout {
+			return conn
+		}
+		conn.Close()
+	}
+	return nil
+}
+
+// put keeps the connection for reuse, unless enough connections are idle or the transport is closed
+func (t *tlsTransport) put(conn *tlsConn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed || len(t.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	conn.lastUsed = time.Now()
+	t.idle = append(t.idle, conn)
+}
+
+func (t *tlsTransport) close() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, conn := range t.idle {
+		conn.Close()
+	}
+	t.idle = nil
+	t.closed = true
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+)
+
+const (
+	tlsScheme   = "tls://"
+	httpsScheme = "https://"
+	tlsPort     = "853"
+	dohPath     = "/dns-query"
+	// idleTimeout is the time idle connections to encrypted nameservers are kept open for reuse
+	idleTimeout = 30 * time.Second
+	// maxIdleConns is the number of idle connections kept per encrypted nameserver
+	maxIdleConns = 4
+)
+
+// transport sends DNS messages to a nameserver
+type transport interface {
+	// exchange sends the message and waits for the response. It returns as soon as the context is done.
+	exchange(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error)
+	// close closes the idle connections, queries in flight are not interrupted
+	close()
+}
+
+// newTransport creates the transport for the scheme of the nameserver address and returns it along with
+// the normalized address. Addresses without scheme use plain DNS over UDP and TCP.
+func newTransport(cfg config.NameserverConfig, timeout time.Duration) (string, transport, error) {
+	switch {
+	case strings.HasPrefix(cfg.Address, tlsScheme):
+		host := strings.TrimPrefix(cfg.Address, tlsScheme)
+		if host == "" {
+			return "", nil, fmt.Errorf("nameserver %s has no host", cfg.Address)
+		}
+		addr := withPort(host, tlsPort)
+		tlsConfig, err := newTLSConfig(cfg, addr)
+		if err != nil {
+			return "", nil, fmt.Errorf("nameserver %s: %v", cfg.Address, err)
+		}
+		return tlsScheme + addr, newTLSTransport(addr, tlsConfig, timeout), nil
+	case strings.HasPrefix(cfg.Address, httpsScheme):
+		u, err := url.Parse(cfg.Address)
+		if err != nil || u.Host == "" {
+			return "", nil, fmt.Errorf("invalid nameserver url %s", cfg.Address)
+		}
+		if u.Path == "" {
+			u.Path = dohPath
+		}
+		tlsConfig, err := newTLSConfig(cfg, u.Host)
+		if err != nil {
+			return "", nil, fmt.Errorf("nameserver %s: %v", cfg.Address, err)
+		}
+		return u.String(), newHTTPSTransport(u.String(), tlsConfig, timeout), nil
+	case strings.Contains(cfg.Address, "://"):
+		return "", nil, fmt.Errorf("nameserver %s has an unsupported scheme", cfg.Address)
+	}
+	addr := address(cfg.Address)
+	return addr, newPlainTransport(addr, timeout), nil
+}
+
+// plainTransport sends messages using UDP and retries using TCP if the response got truncated
+type plainTransport struct {
+	address string
+	timeout time.Duration
+	udp     *mdns.Client
+	tcp     *mdns.Client
+}
+
+func newPlainTransport(address string, timeout time.Duration) *plainTransport {
+	return &plainTransport{
+		address: address,
+		timeout: timeout,
+		udp:     &mdns.Client{Net: "udp", Timeout: timeout},
+		tcp:     &mdns.Client{Net: "tcp", Timeout: timeout},
+	}
+}
+
+func (t *plainTransport) exchange(ctx context.Context, r *mdns.Msg) (*mdns.Msg, error) {
+	resp, err := t.exchangeUsing(ctx, t.udp, r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		return t.exchangeUsing(ctx, t.tcp, r)
+	}
+	return resp, nil
+}
+
+// exchangeUsing sends the message on a new connection of the client, which is closed when the context is done
+func (t *plainTransport) exchangeUsing(ctx context.Context, client *mdns.Client, r *mdns.Msg) (*mdns.Msg, error) {
+	dialer := &net.Dialer{Timeout: t.timeout}
+	conn, err := dialer.DialContext(ctx, client.Net, t.address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	stop := closeOnDone(ctx, conn)
+	resp, _, err := client.ExchangeWithConn(r, &mdns.Conn{Conn: conn})
+	if stop() {
+		return nil, ctx.Err()
+	}
+	return resp, err
+}
+
+func (t *plainTransport) close() {}
+
+// newTLSConfig creates the TLS configuration of an encrypted nameserver. The server name defaults to
+// the host of the address. If pins are configured, the certificate is accepted if its public key matches
+// a pin or if it is issued for the server name by a pinned intermediate or CA, instead of verifying it
+// against the CAs.
+func newTLSConfig(cfg config.NameserverConfig, hostPort string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: cfg.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if tlsConfig.ServerName == "" {
+		host, _, err := net.SplitHostPort(hostPort)
+		if err != nil {
+			host = hostPort
+		}
+		tlsConfig.ServerName = strings.Trim(host, "[]")
+	}
+	if cfg.CAFile != "" {
+		pem, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CAFile)
+		}
+	}
+	if len(cfg.Pins) == 0 {
+		return tlsConfig, nil
+	}
+	pins := map[string]bool{}
+	for _, pin := range cfg.Pins {
+		digest, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %s, a base64 encoded SHA-256 digest is expected", pin)
+		}
+		pins[string(digest)] = true
+	}
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		return verifyPins(state.PeerCertificates, pins, tlsConfig.ServerName)
+	}
+	return tlsConfig, nil
+}
+
+// verifyPins checks the certificates presented by a server against the pins. The handshake is signed with
+// the key of the leaf certificate, so the leaf must match a pin or be issued by a pinned certificate. The
+// other certificates are sent by the server as well, they can't be trusted without verifying the chain.
+func verifyPins(certs []*x509.Certificate, pins map[string]bool, serverName string) error {
+	if len(certs) == 0 {
+		return fmt.Errorf("%s presented no certificate", serverName)
+	}
+	leaf := certs[0]
+	if pinned(leaf, pins) {
+		return nil
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range certs[1:] {
+		if !pinned(cert, pins) {
+			continue
+		}
+		roots := x509.NewCertPool()
+		roots.AddCert(cert)
+		_, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       serverName,
+			Intermediates: intermediates,
+			Roots:         roots,
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("no certificate of %s matches the pins", serverName)
+}
+
+// pinned checks whether the public key of the certificate matches a pin
+func pinned(cert *x509.Certificate, pins map[string]bool) bool {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pins[string(digest[:])]
+}
+
+// closeOnDone closes the connection as soon as the context is done, interrupting a query on it.
+// The returned function must be called once the query is over, it reports whether it was interrupted.
+func closeOnDone(ctx context.Context, conn io.Closer) func() bool {
+	done := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			interrupted <- true
+		case <-done:
+			interrupted <- false
+		}
+	}()
+	return func() bool {
+		close(done)
+		return <-interrupted
+	}
+}
+
+// withPort adds the port to the host if it has none
+func withPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,350 @@
+/*
+Copyright © 2021 Ci4Rail GmbH <engineering@ci4rail.com>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package upstream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/edgefarm/node-dns/pkg/upstream/config"
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+// testCertificate is a certificate for dns.test and 127.0.0.1 along with its chain
+type testCertificate struct {
+	cert   tls.Certificate
+	caFile string
+	pin    string
+}
+
+// newTestCertificate creates a self-signed certificate
+func newTestCertificate(t *testing.T) *testCertificate {
+	return issueTestCertificate(t, nil)
+}
+
+// issueTestCertificate creates a certificate issued by the issuer, which is self-signed without issuer
+func issueTestCertificate(t *testing.T, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "dns.test"},
+		DNSNames:              []string{"dns.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	parent, signer, chain := template, interface{}(key), [][]byte{}
+	if issuer != nil {
+		parent, signer, chain = issuer.cert.Leaf, issuer.cert.PrivateKey, issuer.cert.Certificate
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	return &testCertificate{
+		cert:   tls.Certificate{Certificate: append([][]byte{der}, chain...), PrivateKey: key, Leaf: leaf},
+		caFile: caFile,
+		pin:    base64.StdEncoding.EncodeToString(digest[:]),
+	}
+}
+
+// countingListener counts the accepted connections
+type countingListener struct {
+	net.Listener
+	count *int32
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		atomic.AddInt32(l.count, 1)
+	}
+	return conn, err
+}
+
+// startDoTServer starts a DNS over TLS server on a random local port and counts its connections
+func startDoTServer(t *testing.T, cert *testCertificate, handler mdns.HandlerFunc, conns *int32) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsListener := tls.NewListener(countingListener{Listener: l, count: conns}, &tls.Config{Certificates: []tls.Certificate{cert.cert}})
+	server := &mdns.Server{Listener: tlsListener, Net: "tcp-tls", Handler: handler}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return l.Addr().String()
+}
+
+// startDoHServer starts a DNS over HTTPS server using HTTP/2 and counts its connections
+func startDoHServer(t *testing.T, cert *testCertificate, handler mdns.HandlerFunc, conns *int32) string {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		buf, err := ioutil.ReadAll(r.Body)
+		req := new(mdns.Msg)
+		if r.Method != http.MethodPost || r.URL.Path != "/dns-query" || r.Header.Get("Content-Type") != "application/dns-message" ||
+			err != nil || req.Unpack(buf) != nil || req.Id != 0 {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		recorder := &responseRecorder{}
+		handler(recorder, req)
+		out, _ := recorder.msg.Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(out)
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{cert.cert}}
+	server.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(conns, 1)
+		}
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+// responseRecorder is a mdns.ResponseWriter keeping the written message
+type responseRecorder struct {
+	mdns.ResponseWriter
+	msg *mdns.Msg
+}
+
+func (r *responseRecorder) WriteMsg(msg *mdns.Msg) error {
+	r.msg = msg
+	return nil
+}
+
+func textHandler(text string) mdns.HandlerFunc {
+	return func(w mdns.ResponseWriter, r *mdns.Msg) {
+		msg := new(mdns.Msg)
+		msg.SetReply(r)
+		msg.Answer = append(msg.Answer, &mdns.TXT{
+			Hdr: mdns.RR_Header{Name: r.Question[0].Name, Rrtype: mdns.TypeTXT, Class: mdns.ClassINET, Ttl: 60},
+			Txt: []string{text},
+		})
+		_ = w.WriteMsg(msg)
+	}
+}
+
+func forwardText(f *Forwarder) (string, error) {
+	req := new(mdns.Msg)
+	req.SetQuestion("example.com.", mdns.TypeTXT)
+	resp, err := f.Forward(context.Background(), req)
+	if err != nil {
+		return "", err
+	}
+	if resp.Id != req.Id {
+		return "", fmt.Errorf("response id %d does not match the query id %d", resp.Id, req.Id)
+	}
+	return resp.Answer[0].(*mdns.TXT).Txt[0], nil
+}
+
+func newEncryptedForwarder(t *testing.T, nameserver config.NameserverConfig) *Forwarder {
+	cfg := newTestUpstreamConfig(config.StrategySequential)
+	cfg.Nameservers = []config.NameserverConfig{nameserver}
+	f, err := NewForwarderFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestForwardTLS(t *testing.T) {
+	assert := assert.New(t)
+	cert := newTestCertificate(t)
+	var conns int32
+	addr := startDoTServer(t, cert, textHandler("via tls"), &conns)
+
+	f := newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, ServerName: "dns.test", CAFile: cert.caFile})
+	assert.Equal([]string{"tls://" + addr}, f.Nameservers())
+	for i := 0; i < 3; i++ {
+		text, err := forwardText(f)
+		assert.Nil(err)
+		assert.Equal("via tls", text)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&conns))
+
+	// the certificate is not valid for other names
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, ServerName: "other.test", CAFile: cert.caFile})
+	_, err := forwardText(f)
+	assert.NotNil(err)
+
+	// without CA file the certificate is unknown, unless its key is pinned
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr})
+	_, err = forwardText(f)
+	assert.NotNil(err)
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, Pins: []string{cert.pin}})
+	text, err := forwardText(f)
+	assert.Nil(err)
+	assert.Equal("via tls", text)
+	other := newTestCertificate(t)
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, Pins: []string{other.pin}})
+	_, err = forwardText(f)
+	assert.NotNil(err)
+}
+
+func TestForwardTLSPinnedIssuer(t *testing.T) {
+	assert := assert.New(t)
+	ca := newTestCertificate(t)
+	var conns int32
+	addr := startDoTServer(t, issueTestCertificate(t, ca), textHandler("via tls"), &conns)
+
+	// the leaf is issued by the pinned CA
+	f := newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, Pins: []string{ca.pin}})
+	text, err := forwardText(f)
+	assert.Nil(err)
+	assert.Equal("via tls", text)
+	// but not for other names
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, ServerName: "other.test", Pins: []string{ca.pin}})
+	_, err = forwardText(f)
+	assert.NotNil(err)
+
+	// a server appending the pinned certificate to its own, unrelated leaf is rejected
+	attacker := newTestCertificate(t)
+	attacker.cert.Certificate = append(attacker.cert.Certificate, ca.cert.Certificate...)
+	addr = startDoTServer(t, attacker, textHandler("via attacker"), &conns)
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, Pins: []string{ca.pin}})
+	_, err = forwardText(f)
+	assert.NotNil(err)
+}
+
+func TestForwardTLSReconnects(t *testing.T) {
+	assert := assert.New(t)
+	cert := newTestCertificate(t)
+	var conns int32
+	addr := startDoTServer(t, cert, textHandler("via tls"), &conns)
+	f := newEncryptedForwarder(t, config.NameserverConfig{Address: "tls://" + addr, Pins: []string{cert.pin}})
+
+	_, err := forwardText(f)
+	assert.Nil(err)
+	// the nameserver closes the idle connection
+	transport := f.currentServers()[0].transport.(*tlsTransport)
+	transport.mutex.Lock()
+	transport.idle[0].Close()
+	transport.mutex.Unlock()
+
+	text, err := forwardText(f)
+	assert.Nil(err)
+	assert.Equal("via tls", text)
+	assert.Equal(int32(2), atomic.LoadInt32(&conns))
+}
+
+func TestForwardEncryptedCancel(t *testing.T) {
+	assert := assert.New(t)
+	cert := newTestCertificate(t)
+	var conns int32
+	var count int32
+	blocking := countingHandler(&count, 2*time.Second)
+	for _, address := range []string{
+		"tls://" + startDoTServer(t, cert, blocking, &conns),
+		startDoHServer(t, cert, blocking, &conns),
+	} {
+		cfg := newTestUpstreamConfig(config.StrategySequential)
+		cfg.Timeout = 5 * time.Second
+		cfg.Nameservers = []config.NameserverConfig{{Address: address, Pins: []string{cert.pin}}}
+		f, err := NewForwarderFromConfig(cfg)
+		assert.Nil(err)
+		assert.Less(int64(forwardCancelled(t, f)), int64(time.Second), address)
+	}
+}
+
+func TestForwardHTTPS(t *testing.T) {
+	assert := assert.New(t)
+	cert := newTestCertificate(t)
+	var conns int32
+	url := startDoHServer(t, cert, textHandler("via https"), &conns)
+
+	f := newEncryptedForwarder(t, config.NameserverConfig{Address: url, CAFile: cert.caFile})
+	assert.Equal([]string{url + "/dns-query"}, f.Nameservers())
+	for i := 0; i < 3; i++ {
+		text, err := forwardText(f)
+		assert.Nil(err)
+		assert.Equal("via https", text)
+	}
+	assert.Equal(int32(1), atomic.LoadInt32(&conns))
+
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: url, Pins: []string{cert.pin}})
+	text, err := forwardText(f)
+	assert.Nil(err)
+	assert.Equal("via https", text)
+
+	// the nameserver rejects other paths
+	f = newEncryptedForwarder(t, config.NameserverConfig{Address: url + "/other", Pins: []string{cert.pin}})
+	_, err = forwardText(f)
+	assert.NotNil(err)
+}
+
+func TestNewTransport(t *testing.T) {
+	assert := assert.New(t)
+	for address, expected := range map[string]string{
+		"8.8.8.8":                      "8.8.8.8:53",
+		"tls://1.1.1.1":                "tls://1.1.1.1:853",
+		"tls://[2606:4700::1111]":      "tls://[2606:4700::1111]:853",
+		"tls://dns.example:8853":       "tls://dns.example:8853",
+		"https://dns.example":          "https://dns.example/dns-query",
+		"https://1.1.1.1:8443/resolve": "https://1.1.1.1:8443/resolve",
+	} {
+		addr, _, err := newTransport(config.NameserverConfig{Address: address}, time.Second)
+		assert.Nil(err, address)
+		assert.Equal(expected, addr)
+	}
+	for _, nameserver := range []config.NameserverConfig{
+		{Address: "tls://"},
+		{Address: "https:///dns-query"},
+		{Address: "quic://dns.example"},
+		{Address: "tls://dns.example", Pins: []string{"invalid"}},
+		{Address: "tls://dns.example", CAFile: "/nonexistent/ca.pem"},
+	} {
+		_, _, err := newTransport(nameserver, time.Second)
+		assert.NotNil(err, nameserver.Address)
+	}
+}